@@ -3,34 +3,71 @@ package apt
 import (
 	"math"
 	"math/rand"
-	"reflect"
 	"strconv"
+	"sync"
 
 	"github.com/ahmadfarhanstwn/noise"
 )
 
+// Animated lets GetRandomLeafNode pick t, so pictures generated and mutated
+// while it is set can change over time.
+var Animated bool
+
 type Node interface {
 	Eval(x, y float32) float32
+	EvalRow(xs []float32, y float32, out []float32)
 	String() string
 	SetParent(node Node)
 	SetChildren(children []Node)
-	AddRandom(node Node)
+	AddRandom(node Node, r *rand.Rand)
 	AddLeaf(nodeLeaf Node) bool
 	CountNode() int
 	GetChildren() []Node
 	GetParent() Node
 }
 
+// ParamNode is implemented by nodes that are written with literal parameters
+// ahead of their children, like the name in ( image "name" u v ). Params
+// returns them as they are written and SetParams takes them back.
+type ParamNode interface {
+	Node
+	Params() []string
+	SetParams(params []string) error
+}
+
+// funcNode is implemented by nodes whose value only depends on the values of
+// their children, so they can be folded and compiled like operators with an
+// Eval in their spec.
+type funcNode interface {
+	apply(args []float32) float32
+}
+
+// randomizer is implemented by nodes with random state of their own, like the
+// value of a constant. Their constructors leave it at zero so that parsing
+// and copying don't draw random numbers, and randomNode fills it in from the
+// generator it is given.
+type randomizer interface {
+	randomize(r *rand.Rand)
+}
+
 type BaseNode struct {
 	Parent Node
 	Children []Node
 }
 
 func CopyTree(node, parent Node) Node {
-	copy := reflect.New(reflect.ValueOf(node).Elem().Type()).Interface().(Node)
-	switch n := node.(type) {
-	case *OpConst:
-		copy.(*OpConst).value = n.value
+	var copy Node
+	if n, ok := node.(*OpConst); ok {
+		copy = &OpConst{BaseNode{nil, make([]Node, 0)}, n.value}
+	} else if s := specOf(node); s != nil {
+		copy = newNode(s)
+	} else {
+		panic("tried to copy unregistered node " + node.String())
+	}
+	if pn, ok := node.(ParamNode); ok {
+		if err := copy.(ParamNode).SetParams(pn.Params()); err != nil {
+			panic(err)
+		}
 	}
 	copy.SetParent(parent)
 	copyChildren := make([]Node, len(node.GetChildren()))
@@ -52,6 +89,7 @@ func ReplaceNode(old, new Node) {
 		}
 	}
 	new.SetParent(oldParent)
+	treeChanged()
 }
 
 func GetNthChildren(node Node, n, count int) (Node, int) {
@@ -69,13 +107,18 @@ func GetNthChildren(node Node, n, count int) (Node, int) {
 	return nil, count
 } 
 
-func Mutate(node Node) Node {
-	r := rand.Intn(23)
+// Mutate replaces node with a random node drawn from r, which takes over as
+// many of node's children as it has room for, or now and then with a gene
+// from the bank.
+func Mutate(node Node, r *rand.Rand) Node {
 	var MutateNode Node
-	if r <= 19 {
-		MutateNode = GetRandomNodeOpt()
+	_, gene := RandomGene(r)
+	if gene != nil {
+		MutateNode = gene
+	} else if r.Intn(23) <= 19 {
+		MutateNode = GetRandomNodeOpt(r)
 	} else {
-		MutateNode = GetRandomLeafNode()
+		MutateNode = GetRandomLeafNode(r)
 	}
 
 	if node.GetParent() != nil {
@@ -87,7 +130,7 @@ func Mutate(node Node) Node {
 	}
 
 	for i, child := range node.GetChildren() {
-		if i >= len(MutateNode.GetChildren()) {
+		if gene != nil || i >= len(MutateNode.GetChildren()) {
 			break
 		}
 		MutateNode.GetChildren()[i] = child
@@ -96,13 +139,14 @@ func Mutate(node Node) Node {
 
 	for i, child := range MutateNode.GetChildren() {
 		if child == nil {
-			leaf := GetRandomLeafNode()
+			leaf := GetRandomLeafNode(r)
 			leaf.SetParent(MutateNode)
 			MutateNode.GetChildren()[i] = leaf
 		}
 	}
 
 	MutateNode.SetParent(node.GetParent())
+	treeChanged()
 	return MutateNode
 }
 
@@ -118,6 +162,10 @@ func (base *BaseNode) Eval(x, y float32) float32 {
 	panic("tried to eval base node")
 }
 
+func (base *BaseNode) EvalRow(xs []float32, y float32, out []float32) {
+	panic("tried to eval base node")
+}
+
 func (base *BaseNode) String() string {
 	panic("tried to string basenode")
 }
@@ -128,15 +176,17 @@ func (base *BaseNode) SetParent(parent Node) {
 
 func (base *BaseNode) SetChildren(children []Node) {
 	base.Children = children
+	treeChanged()
 }
 
-func (base *BaseNode) AddRandom(node Node) {
-	index := rand.Intn(len(base.Children))
+func (base *BaseNode) AddRandom(node Node, r *rand.Rand) {
+	index := r.Intn(len(base.Children))
 	if base.Children[index] == nil {
 		node.SetParent(base)
 		base.Children[index] = node
+		treeChanged()
 	} else {
-		base.Children[index].AddRandom(node)
+		base.Children[index].AddRandom(node, r)
 	}
 }
 
@@ -145,6 +195,7 @@ func (base *BaseNode) AddLeaf(leafNode Node) bool {
 		if node == nil {
 			leafNode.SetParent(node)
 			base.Children[i] = leafNode
+			treeChanged()
 			return true
 		} else if base.Children[i].AddLeaf(leafNode) {
 			return true
@@ -173,6 +224,17 @@ func (op *OpPlus) Eval(x, y float32) float32 {
 	return op.Children[0].Eval(x, y) + op.Children[1].Eval(x, y)
 }
 
+func (op *OpPlus) EvalRow(xs []float32, y float32, out []float32) {
+	s := getRows(1, len(xs))
+	defer s.release()
+	b := s.rows[0]
+	op.Children[0].EvalRow(xs, y, out)
+	op.Children[1].EvalRow(xs, y, b)
+	for i := range out {
+		out[i] = out[i] + b[i]
+	}
+}
+
 func (op *OpPlus) String() string {
 	return "( + " + op.Children[0].String() + " " + op.Children[1].String() + " )"
 }
@@ -189,6 +251,17 @@ func (op *OpMinus) Eval(x, y float32) float32 {
 	return op.Children[0].Eval(x, y) - op.Children[1].Eval(x, y)
 }
 
+func (op *OpMinus) EvalRow(xs []float32, y float32, out []float32) {
+	s := getRows(1, len(xs))
+	defer s.release()
+	b := s.rows[0]
+	op.Children[0].EvalRow(xs, y, out)
+	op.Children[1].EvalRow(xs, y, b)
+	for i := range out {
+		out[i] = out[i] - b[i]
+	}
+}
+
 func (op *OpMinus) String() string {
 	return "( - " + op.Children[0].String() + " " + op.Children[1].String() + " )"
 }
@@ -205,6 +278,17 @@ func (op *OpMultiplies) Eval(x, y float32) float32 {
 	return op.Children[0].Eval(x, y) * op.Children[1].Eval(x, y)
 }
 
+func (op *OpMultiplies) EvalRow(xs []float32, y float32, out []float32) {
+	s := getRows(1, len(xs))
+	defer s.release()
+	b := s.rows[0]
+	op.Children[0].EvalRow(xs, y, out)
+	op.Children[1].EvalRow(xs, y, b)
+	for i := range out {
+		out[i] = out[i] * b[i]
+	}
+}
+
 func (op *OpMultiplies) String() string {
 	return "( * " + op.Children[0].String() + " " + op.Children[1].String() + " )"
 }
@@ -221,6 +305,17 @@ func (op *OpDivide) Eval(x, y float32) float32 {
 	return op.Children[0].Eval(x, y) / op.Children[1].Eval(x, y)
 }
 
+func (op *OpDivide) EvalRow(xs []float32, y float32, out []float32) {
+	s := getRows(1, len(xs))
+	defer s.release()
+	b := s.rows[0]
+	op.Children[0].EvalRow(xs, y, out)
+	op.Children[1].EvalRow(xs, y, b)
+	for i := range out {
+		out[i] = out[i] / b[i]
+	}
+}
+
 func (op *OpDivide) String() string {
 	return "( / " + op.Children[0].String() + " " + op.Children[1].String() + " )"
 }
@@ -237,6 +332,12 @@ func (op *OpAtan2) Eval(x, y float32) float32 {
 	return float32(math.Atan2(float64(y),float64(x)))
 }
 
+func (op *OpAtan2) EvalRow(xs []float32, y float32, out []float32) {
+	for i := range out {
+		out[i] = float32(math.Atan2(float64(y), float64(xs[i])))
+	}
+}
+
 func (op *OpAtan2) String() string {
 	return "( atan2 " + op.Children[0].String() + " " + op.Children[1].String() + " )"
 }
@@ -253,6 +354,13 @@ func (op *OpSin) Eval(x, y float32) float32 {
 	return float32(math.Sin(float64(op.Children[0].Eval(x,y))))
 }
 
+func (op *OpSin) EvalRow(xs []float32, y float32, out []float32) {
+	op.Children[0].EvalRow(xs, y, out)
+	for i := range out {
+		out[i] = float32(math.Sin(float64(out[i])))
+	}
+}
+
 func (op *OpSin) String() string {
 	return "( sin " + op.Children[0].String() + " )"
 }
@@ -269,6 +377,13 @@ func (op *OpCos) Eval(x, y float32) float32 {
 	return float32(math.Cos(float64(op.Children[0].Eval(x,y))))
 }
 
+func (op *OpCos) EvalRow(xs []float32, y float32, out []float32) {
+	op.Children[0].EvalRow(xs, y, out)
+	for i := range out {
+		out[i] = float32(math.Cos(float64(out[i])))
+	}
+}
+
 func (op *OpCos) String() string {
 	return "( cos " + op.Children[0].String() + " )"
 }
@@ -285,6 +400,13 @@ func (op *OpAtan) Eval(x, y float32) float32 {
 	return float32(math.Atan(float64(op.Children[0].Eval(x,y))))
 }
 
+func (op *OpAtan) EvalRow(xs []float32, y float32, out []float32) {
+	op.Children[0].EvalRow(xs, y, out)
+	for i := range out {
+		out[i] = float32(math.Atan(float64(out[i])))
+	}
+}
+
 func (op *OpAtan) String() string {
 	return "( atan " + op.Children[0].String() + " )"
 }
@@ -298,7 +420,18 @@ func NewOpNoise() *opNoise {
 }
 
 func (op *opNoise) Eval(x, y float32) float32 {
-	return 80*noise.Snoise2(op.Children[0].Eval(x,y),op.Children[1].Eval(x,y))-2.0
+	return float32(80*noise.Snoise2(op.Children[0].Eval(x,y),op.Children[1].Eval(x,y)))-2.0
+}
+
+func (op *opNoise) EvalRow(xs []float32, y float32, out []float32) {
+	s := getRows(1, len(xs))
+	defer s.release()
+	b := s.rows[0]
+	op.Children[0].EvalRow(xs, y, out)
+	op.Children[1].EvalRow(xs, y, b)
+	for i := range out {
+		out[i] = float32(80*noise.Snoise2(out[i], b[i])) - 2.0
+	}
 }
 
 func (op *opNoise) String() string {
@@ -318,6 +451,13 @@ func (opsquare *OpSquare) Eval(x, y float32) float32 {
 	return val*val
 }
 
+func (opsquare *OpSquare) EvalRow(xs []float32, y float32, out []float32) {
+	opsquare.Children[0].EvalRow(xs, y, out)
+	for i := range out {
+		out[i] = out[i] * out[i]
+	}
+}
+
 func (opsquare *OpSquare) String() string {
 	return "( square " + opsquare.Children[0].String() + " )"
 }
@@ -334,6 +474,13 @@ func (opnegate *OpNegate) Eval(x, y float32) float32 {
 	return -opnegate.Children[0].Eval(x,y)
 }
 
+func (opnegate *OpNegate) EvalRow(xs []float32, y float32, out []float32) {
+	opnegate.Children[0].EvalRow(xs, y, out)
+	for i := range out {
+		out[i] = -out[i]
+	}
+}
+
 func (opnegate *OpNegate) String() string {
 	return "( negate " + opnegate.Children[0].String() + " )"
 }
@@ -350,6 +497,13 @@ func (opceil *OpCeil) Eval(x, y float32) float32 {
 	return float32(math.Ceil(float64(opceil.Children[0].Eval(x,y))))
 }
 
+func (opceil *OpCeil) EvalRow(xs []float32, y float32, out []float32) {
+	opceil.Children[0].EvalRow(xs, y, out)
+	for i := range out {
+		out[i] = float32(math.Ceil(float64(out[i])))
+	}
+}
+
 func (opceil *OpCeil) String() string {
 	return "( ceil " + opceil.Children[0].String() + " )"
 }
@@ -366,6 +520,13 @@ func (opfloor *OpFloor) Eval(x, y float32) float32 {
 	return float32(math.Floor(float64(opfloor.Children[0].Eval(x,y))))
 }
 
+func (opfloor *OpFloor) EvalRow(xs []float32, y float32, out []float32) {
+	opfloor.Children[0].EvalRow(xs, y, out)
+	for i := range out {
+		out[i] = float32(math.Floor(float64(out[i])))
+	}
+}
+
 func (opfloor *OpFloor) String() string {
 	return "( floor " + opfloor.Children[0].String() + " )"
 }
@@ -382,40 +543,168 @@ func (opabs *OpAbs) Eval(x, y float32) float32 {
 	return float32(math.Abs(float64(opabs.Children[0].Eval(x,y))))
 }
 
+func (opabs *OpAbs) EvalRow(xs []float32, y float32, out []float32) {
+	opabs.Children[0].EvalRow(xs, y, out)
+	for i := range out {
+		out[i] = float32(math.Abs(float64(out[i])))
+	}
+}
+
 func (opabs *OpAbs) String() string {
 	return "( abs " + opabs.Children[0].String() + " )"
 }
 
+// The fractal noise operators take their gain, lacunarity and octave count as
+// children, so they can evolve like anything else. Files from before they
+// did leave them out and get these defaults.
+const (
+	defaultGain       = 0.5
+	defaultLacunarity = 2
+	defaultOctaves    = 3
+	maxOctaves        = 8
+)
+
+// octaveCount rounds v to a whole number of octaves, keeping it sensible.
+func octaveCount(v float32) int {
+	if !(v >= 1) {
+		return 1
+	}
+	if v >= maxOctaves {
+		return maxOctaves
+	}
+	return int(v + 0.5)
+}
+
+func fbm(args []float32) float32 {
+	return noise.Fbm2(args[0], args[1], args[2], args[3], args[4], octaveCount(args[5]))
+}
+
+func turbulence(args []float32) float32 {
+	return noise.Turbulence(args[0], args[1], args[2], args[3], args[4], octaveCount(args[5]))
+}
+
+// evalChildren evaluates each child of node at x, y into args.
+func evalChildren(node Node, x, y float32, args []float32) []float32 {
+	for i, child := range node.GetChildren() {
+		args[i] = child.Eval(x, y)
+	}
+	return args
+}
+
+// evalChildRows evaluates each child of node over the row into rows.
+func evalChildRows(node Node, xs []float32, y float32, rows [][]float32) [][]float32 {
+	for i, child := range node.GetChildren() {
+		child.EvalRow(xs, y, rows[i])
+	}
+	return rows
+}
+
+// rowPool holds the rows that EvalRow evaluates children into besides out,
+// so evaluating a tree row after row doesn't allocate new ones at every node.
+var rowPool = sync.Pool{New: func() interface{} { return new(scratchRows) }}
+
+// scratchRows are rows borrowed from rowPool, and the arguments for operators
+// applied a point at a time.
+type scratchRows struct {
+	rows [][]float32
+	args []float32
+	// all keeps every row for later, when rows is cut short
+	all [][]float32
+}
+
+// getRows borrows count rows of n values each, whatever they held before,
+// and room for count arguments. They go back with release.
+func getRows(count, n int) *scratchRows {
+	s := rowPool.Get().(*scratchRows)
+	for len(s.all) < count {
+		s.all = append(s.all, nil)
+	}
+	for i, row := range s.all[:count] {
+		if cap(row) < n {
+			row = make([]float32, n)
+		}
+		s.all[i] = row[:n]
+	}
+	s.rows = s.all[:count]
+	if cap(s.args) < count {
+		s.args = make([]float32, count)
+	}
+	s.args = s.args[:count]
+	return s
+}
+
+func (s *scratchRows) release() {
+	rowPool.Put(s)
+}
+
+func childrenString(name string, children []Node) string {
+	s := "( " + name
+	for _, child := range children {
+		s += " " + child.String()
+	}
+	return s + " )"
+}
+
 type OpFbm struct {
 	BaseNode
 }
 
+// NewOpFbm makes ( fbm x y frequency gain lacunarity octaves ).
 func NewOpFbm() *OpFbm {
-	return &OpFbm{BaseNode{nil, make([]Node, 3)}}
+	return &OpFbm{BaseNode{nil, make([]Node, 6)}}
 }
 
 func (opfbm *OpFbm) Eval(x, y float32) float32 {
-	return noise.Fbm2(opfbm.Children[0].Eval(x,y), opfbm.Children[1].Eval(x,y), opfbm.Children[2].Eval(x,y), 0.5, 2, 3)
+	var args [6]float32
+	return fbm(evalChildren(opfbm, x, y, args[:]))
+}
+
+func (opfbm *OpFbm) EvalRow(xs []float32, y float32, out []float32) {
+	s := getRows(6, len(xs))
+	defer s.release()
+	rows := evalChildRows(opfbm, xs, y, s.rows)
+	var args [6]float32
+	for i := range out {
+		for j, row := range rows {
+			args[j] = row[i]
+		}
+		out[i] = fbm(args[:])
+	}
 }
 
 func (opfbm *OpFbm) String() string {
-	return "( fbm " + opfbm.Children[0].String() + " " + opfbm.Children[1].String() + " " + opfbm.Children[2].String() + " )"
+	return childrenString("fbm", opfbm.Children)
 }
 
 type OpTurbulence struct {
 	BaseNode
 }
 
-func NewTurbulence() *OpFbm {
-	return &OpFbm{BaseNode{nil, make([]Node, 3)}}
+// NewTurbulence makes ( turbulence x y frequency gain lacunarity octaves ).
+func NewTurbulence() *OpTurbulence {
+	return &OpTurbulence{BaseNode{nil, make([]Node, 6)}}
 }
 
 func (opturbulence *OpTurbulence) Eval(x, y float32) float32 {
-	return noise.Turbulence(opturbulence.Children[0].Eval(x,y), opturbulence.Children[1].Eval(x,y), opturbulence.Children[2].Eval(x,y), 0.5, 2, 3)
+	var args [6]float32
+	return turbulence(evalChildren(opturbulence, x, y, args[:]))
+}
+
+func (opturbulence *OpTurbulence) EvalRow(xs []float32, y float32, out []float32) {
+	s := getRows(6, len(xs))
+	defer s.release()
+	rows := evalChildRows(opturbulence, xs, y, s.rows)
+	var args [6]float32
+	for i := range out {
+		for j, row := range rows {
+			args[j] = row[i]
+		}
+		out[i] = turbulence(args[:])
+	}
 }
 
 func (opturbulence *OpTurbulence) String() string {
-	return "( turbulence " + opturbulence.Children[0].String() + " " + opturbulence.Children[1].String() + " " + opturbulence.Children[2].String() + " )"
+	return childrenString("turbulence", opturbulence.Children)
 }
 
 type OpX struct {
@@ -430,6 +719,12 @@ func (opx *OpX) Eval(x, y float32) float32 {
 	return x
 }
 
+func (opx *OpX) EvalRow(xs []float32, y float32, out []float32) {
+	for i := range out {
+		out[i] = xs[i]
+	}
+}
+
 func (opx *OpX) String() string {
 	return "x"
 }
@@ -446,23 +741,63 @@ func (opy *OpY) Eval(x, y float32) float32 {
 	return y
 }
 
+func (opy *OpY) EvalRow(xs []float32, y float32, out []float32) {
+	for i := range out {
+		out[i] = y
+	}
+}
+
 func (opy *OpY) String() string {
 	return "y"
 }
 
+// OpT is the time of an animated picture. Only a compiled Program knows what
+// time it is, the tree walker always evaluates the first frame, t = 0.
+type OpT struct {
+	BaseNode
+}
+
+func NewOpT() *OpT {
+	return &OpT{BaseNode{nil, make([]Node, 0)}}
+}
+
+func (opt *OpT) Eval(x, y float32) float32 {
+	return 0
+}
+
+func (opt *OpT) EvalRow(xs []float32, y float32, out []float32) {
+	for i := range out {
+		out[i] = 0
+	}
+}
+
+func (opt *OpT) String() string {
+	return "t"
+}
+
 type OpConst struct {
 	BaseNode
 	value float32
 }
 
 func NewOpConst() *OpConst {
-	return &OpConst{BaseNode{nil, make([]Node, 0)}, rand.Float32()*2-1}
+	return &OpConst{BaseNode{nil, make([]Node, 0)}, 0}
+}
+
+func (opconst *OpConst) randomize(r *rand.Rand) {
+	opconst.value = r.Float32()*2-1
 }
 
 func (opconst *OpConst) Eval(x, y float32) float32 {
 	return opconst.value
 }
 
+func (opconst *OpConst) EvalRow(xs []float32, y float32, out []float32) {
+	for i := range out {
+		out[i] = opconst.value
+	}
+}
+
 func (opconst *OpConst) String() string {
 	return strconv.FormatFloat(float64(opconst.value),'f',9,32)
 }
@@ -479,58 +814,24 @@ func (oppict *OpPict) Eval(x, y float32) float32 {
 	panic("tried to eval root of pict")
 }
 
+func (oppict *OpPict) EvalRow(xs []float32, y float32, out []float32) {
+	panic("tried to eval root of pict")
+}
+
 func (oppict *OpPict) String() string {
 	return "( picture\n" + oppict.Children[0].String() + "\n" + oppict.Children[1].String() + "\n" + oppict.Children[2].String() + " )"
 }
 
-func GetRandomNodeOpt() Node {
-	r := rand.Intn(16)
-	switch r {
-	case 0:
-		return NewOpPlus()
-	case 1:
-		return NewOpMinus()
-	case 2:
-		return NewOpMultiplies()
-	case 3:
-		return NewOpDivide()
-	case 4:
-		return NewOpAtan2()
-	case 5:
-		return NewOpAtan()
-	case 6:
-		return NewOpSin()
-	case 7:
-		return NewOpCos()
-	case 8:
-		return NewOpNoise()
-	case 9:
-		return NewTurbulence()
-	case 10:
-		return NewOpCeil()
-	case 11:
-		return NewOpFbm()
-	case 12:
-		return NewOpFloor()
-	case 13:
-		return NewOpNegate()
-	case 14:
-		return NewOpSquare()
-	case 15:
-		return NewOpAbs()
-	}
-	panic("get random operation failed")
-}
-
-func GetRandomLeafNode() Node {
-	r := rand.Intn(3)
-	switch r {
-	case 0:
-		return NewOpX()
-	case 1:
-		return NewOpY()
-	case 2:
-		return NewOpConst()
-	}
-	panic("get random leaf node failed")
-}
\ No newline at end of file
+func GetRandomNodeOpt(r *rand.Rand) Node {
+	return randomNode(r, false, 0)
+}
+
+func GetRandomLeafNode(r *rand.Rand) Node {
+	// constants aren't registered operators, they get the same chance as x
+	if leaf := randomNode(r, true, 1); leaf != nil {
+		return leaf
+	}
+	c := NewOpConst()
+	c.randomize(r)
+	return c
+}
@@ -0,0 +1,204 @@
+package apt
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+
+	"github.com/ahmadfarhanstwn/noise"
+)
+
+// hash2 scrambles a lattice point and a seed into 32 random looking bits.
+func hash2(ix, iy int32, seed uint32) uint32 {
+	h := seed ^ uint32(ix)*0x27d4eb2d ^ uint32(iy)*0x165667b1
+	h ^= h >> 15
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+func unitFloat(h uint32) float64 {
+	return float64(float64(h>>8) / (1 << 24))
+}
+
+// lattice floors v, keeping far away points from overflowing int32.
+func lattice(v float64) (int32, float64) {
+	v = math.Max(-1<<30, math.Min(1<<30, v))
+	f := math.Floor(v)
+	return int32(f), v - f
+}
+
+// worley returns the distances from x, y to the closest and second closest
+// of the feature points scattered one per unit cell, or NaN if x or y is.
+// The products are converted explicitly for the reason given in math.go.
+func worley(seed uint32, x, y float32) (f1, f2 float64) {
+	if x != x || y != y {
+		return math.NaN(), math.NaN()
+	}
+	ix, fx := lattice(float64(x))
+	iy, fy := lattice(float64(y))
+	f1, f2 = math.Inf(1), math.Inf(1)
+	for dy := int32(-1); dy <= 1; dy++ {
+		for dx := int32(-1); dx <= 1; dx++ {
+			h := hash2(ix+dx, iy+dy, seed)
+			px := float64(dx) + unitFloat(h) - fx
+			py := float64(dy) + unitFloat(hash2(ix+dx, iy+dy, h)) - fy
+			d := math.Sqrt(float64(px*px) + float64(py*py))
+			if d < f1 {
+				f1, f2 = d, f1
+			} else if d < f2 {
+				f2 = d
+			}
+		}
+	}
+	return f1, f2
+}
+
+func worleyF1(seed uint32, x, y float32) float32 {
+	f1, _ := worley(seed, x, y)
+	return float32(float64(f1*2) - 1)
+}
+
+func worleyF2(seed uint32, x, y float32) float32 {
+	_, f2 := worley(seed, x, y)
+	return float32(float64(f2*2) - 1)
+}
+
+func worleyEdge(seed uint32, x, y float32) float32 {
+	f1, f2 := worley(seed, x, y)
+	return float32(float64((f2-f1)*2) - 1)
+}
+
+// valueNoise interpolates random values on the lattice points smoothly.
+func valueNoise(seed uint32, x, y float32) float32 {
+	ix, fx := lattice(float64(x))
+	iy, fy := lattice(float64(y))
+	value := func(dx, dy int32) float64 {
+		return float64(unitFloat(hash2(ix+dx, iy+dy, seed))*2) - 1
+	}
+	sx := fx * fx * (3 - float64(2*fx))
+	sy := fy * fy * (3 - float64(2*fy))
+	top := value(0, 0) + float64((value(1, 0)-value(0, 0))*sx)
+	bottom := value(0, 1) + float64((value(1, 1)-value(0, 1))*sx)
+	return float32(top + float64((bottom-top)*sy))
+}
+
+// ridged is Musgrave's ridged multifractal over simplex noise, shifted by
+// the seed, with 4 octaves.
+func ridged(seed uint32, x, y float32) float32 {
+	const octaves, lacunarity, gain, offset = 4, 2.0, 2.0, 1.0
+	ox := float32(unitFloat(hash2(0, 0, seed)) * 256)
+	oy := float32(unitFloat(hash2(1, 0, seed)) * 256)
+
+	var result, weight, amplitude float64 = 0, 1, 1
+	for i := 0; i < octaves; i++ {
+		n := float64(40 * noise.Snoise2(x+ox, y+oy))
+		signal := offset - math.Abs(n)
+		signal = float64(signal * signal * weight)
+		result += float64(signal * amplitude)
+		weight = math.Max(0, math.Min(1, signal*gain))
+		x, y = x*lacunarity, y*lacunarity
+		amplitude /= lacunarity
+	}
+	return float32(result - 1)
+}
+
+// seededNoise is shared by the noise nodes below. Each node has its own
+// seed, written as a parameter, so two of them in a picture look different
+// and a saved picture looks the same when it is loaded again.
+type seededNoise struct {
+	BaseNode
+	name string
+	seed uint32
+	f    func(seed uint32, x, y float32) float32
+}
+
+func newSeededNoise(name string, f func(seed uint32, x, y float32) float32) seededNoise {
+	return seededNoise{BaseNode{nil, make([]Node, 2)}, name, 0, f}
+}
+
+func (op *seededNoise) randomize(r *rand.Rand) {
+	op.seed = r.Uint32()
+}
+
+func (op *seededNoise) Params() []string {
+	return []string{strconv.FormatUint(uint64(op.seed), 10)}
+}
+
+func (op *seededNoise) SetParams(params []string) error {
+	seed, err := strconv.ParseUint(params[0], 10, 32)
+	if err != nil {
+		return fmt.Errorf("seed of %s must be a whole number, got %s", op.name, params[0])
+	}
+	op.seed = uint32(seed)
+	return nil
+}
+
+func (op *seededNoise) apply(args []float32) float32 {
+	return op.f(op.seed, args[0], args[1])
+}
+
+func (op *seededNoise) Eval(x, y float32) float32 {
+	return op.f(op.seed, op.Children[0].Eval(x, y), op.Children[1].Eval(x, y))
+}
+
+func (op *seededNoise) EvalRow(xs []float32, y float32, out []float32) {
+	s := getRows(1, len(xs))
+	defer s.release()
+	b := s.rows[0]
+	op.Children[0].EvalRow(xs, y, out)
+	op.Children[1].EvalRow(xs, y, b)
+	for i := range out {
+		out[i] = op.f(op.seed, out[i], b[i])
+	}
+}
+
+func (op *seededNoise) String() string {
+	return "( " + op.name + " " + strconv.FormatUint(uint64(op.seed), 10) + " " + op.Children[0].String() + " " + op.Children[1].String() + " )"
+}
+
+// OpWorleyF1 is cellular noise, the distance to the closest feature point.
+type OpWorleyF1 struct {
+	seededNoise
+}
+
+func NewOpWorleyF1() *OpWorleyF1 {
+	return &OpWorleyF1{newSeededNoise("worleyf1", worleyF1)}
+}
+
+// OpWorleyF2 is the distance to the second closest feature point.
+type OpWorleyF2 struct {
+	seededNoise
+}
+
+func NewOpWorleyF2() *OpWorleyF2 {
+	return &OpWorleyF2{newSeededNoise("worleyf2", worleyF2)}
+}
+
+// OpWorleyEdge is F2 - F1, which is 0 on the edges between cells.
+type OpWorleyEdge struct {
+	seededNoise
+}
+
+func NewOpWorleyEdge() *OpWorleyEdge {
+	return &OpWorleyEdge{newSeededNoise("worleyf2f1", worleyEdge)}
+}
+
+type OpValueNoise struct {
+	seededNoise
+}
+
+func NewOpValueNoise() *OpValueNoise {
+	return &OpValueNoise{newSeededNoise("valuenoise", valueNoise)}
+}
+
+type OpRidged struct {
+	seededNoise
+}
+
+func NewOpRidged() *OpRidged {
+	return &OpRidged{newSeededNoise("ridged", ridged)}
+}
@@ -0,0 +1,491 @@
+package apt
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/ahmadfarhanstwn/noise"
+)
+
+type opcode uint8
+
+const (
+	codeConst opcode = iota
+	codeX
+	codeY
+	codeT
+	codePlus
+	codeMinus
+	codeMultiplies
+	codeDivide
+	codeAtan2
+	codeAtan
+	codeSin
+	codeCos
+	codeNoise
+	codeSquare
+	codeNegate
+	codeCeil
+	codeFloor
+	codeAbs
+	// codeWarp, codeRotate, codeScale and codePolar move the coordinates
+	// until the matching codeRestore
+	codeWarp
+	codeRotate
+	codeScale
+	codePolar
+	codeRestore
+	// codeCall applies fn to the arity values on top of the stack
+	codeCall
+)
+
+type instr struct {
+	op    opcode
+	value float32
+	fn    func(args []float32) float32
+	arity int
+}
+
+// Program is an APT tree lowered to a flat stack machine program. It gives
+// exactly the same results as calling Eval on the tree it was compiled from,
+// without walking pointers and making interface calls for every node.
+type Program struct {
+	code      []instr
+	stackSize int
+	policy    NumericPolicy
+	// transforms counts the transforms, each needing a pair of coordinate
+	// rows in EvalRow
+	transforms int
+}
+
+func Compile(node Node) (*Program, error) {
+	return CompileWith(node, Strict)
+}
+
+// CompileWith compiles node to a program that follows policy. Only Strict
+// gives the same results as Eval. Operators registered with New but no Eval
+// can't be compiled, since their subtrees would only see time 0 and Strict.
+func CompileWith(node Node, policy NumericPolicy) (*Program, error) {
+	p := &Program{policy: policy}
+	if err := p.emit(node, 0); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// emit appends the code for node, which will find depth values already on the
+// stack, and keeps track of how deep the stack can get.
+func (p *Program) emit(node Node, depth int) error {
+	var op opcode
+	switch n := node.(type) {
+	case *OpConst:
+		p.push(instr{op: codeConst, value: n.value}, depth)
+		return nil
+	case *OpX:
+		p.push(instr{op: codeX}, depth)
+		return nil
+	case *OpY:
+		p.push(instr{op: codeY}, depth)
+		return nil
+	case *OpT:
+		p.push(instr{op: codeT}, depth)
+		return nil
+	case *OpAtan2:
+		// the tree walker ignores the children of atan2, so the program does too
+		p.push(instr{op: codeAtan2}, depth)
+		return nil
+	case *OpWarp:
+		return p.emitTransform(n.Children, codeWarp, depth)
+	case *OpRotate:
+		return p.emitTransform(n.Children, codeRotate, depth)
+	case *OpScale:
+		return p.emitTransform(n.Children, codeScale, depth)
+	case *OpPolar:
+		return p.emitTransform(n.Children, codePolar, depth)
+	case *OpDdx:
+		return p.emit(n.derived(), depth)
+	case *OpDdy:
+		return p.emit(n.derived(), depth)
+	case *OpPlus:
+		op = codePlus
+	case *OpMinus:
+		op = codeMinus
+	case *OpMultiplies:
+		op = codeMultiplies
+	case *OpDivide:
+		op = codeDivide
+	case *OpAtan:
+		op = codeAtan
+	case *OpSin:
+		op = codeSin
+	case *OpCos:
+		op = codeCos
+	case *opNoise:
+		op = codeNoise
+	case *OpSquare:
+		op = codeSquare
+	case *OpNegate:
+		op = codeNegate
+	case *OpCeil:
+		op = codeCeil
+	case *OpFloor:
+		op = codeFloor
+	case *OpAbs:
+		op = codeAbs
+	default:
+		// any other operator that only depends on its children can be
+		// called through its spec, or applied by the node itself, and the
+		// rest can't be compiled
+		var fn func(args []float32) float32
+		if f, ok := node.(funcNode); ok {
+			fn = f.apply
+		} else if s := specOf(node); s != nil && s.Eval != nil {
+			fn = s.Eval
+		}
+		if fn != nil {
+			children := node.GetChildren()
+			if err := p.emitChildren(children, depth); err != nil {
+				return err
+			}
+			p.push(instr{op: codeCall, fn: fn, arity: len(children)}, depth)
+			return nil
+		}
+		return fmt.Errorf("can't compile %s", nodeName(node))
+	}
+
+	if err := p.emitChildren(node.GetChildren(), depth); err != nil {
+		return err
+	}
+	p.code = append(p.code, instr{op: op})
+	return nil
+}
+
+// emitChildren emits children one after another, the first at depth.
+func (p *Program) emitChildren(children []Node, depth int) error {
+	for i, child := range children {
+		if err := p.emit(child, depth+i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emitTransform emits the children that say how to move the coordinates,
+// then op to move them, then the body, the last child, and codeRestore.
+func (p *Program) emitTransform(children []Node, op opcode, depth int) error {
+	last := len(children) - 1
+	if err := p.emitChildren(children[:last], depth); err != nil {
+		return err
+	}
+	p.code = append(p.code, instr{op: op})
+	p.transforms++
+	if err := p.emit(children[last], depth); err != nil {
+		return err
+	}
+	p.code = append(p.code, instr{op: codeRestore})
+	return nil
+}
+
+func (p *Program) push(in instr, depth int) {
+	p.code = append(p.code, in)
+	if depth+1 > p.stackSize {
+		p.stackSize = depth + 1
+	}
+}
+
+func (p *Program) Eval(x, y float32) float32 {
+	return p.EvalAt(x, y, 0)
+}
+
+// EvalAt evaluates the program at time t, which is what any t leaves in the
+// tree give.
+func (p *Program) EvalAt(x, y, t float32) float32 {
+	var buf [32]float32
+	stack := buf[:]
+	if p.stackSize > len(buf) {
+		stack = make([]float32, p.stackSize)
+	}
+
+	var savedBuf [8][2]float32
+	saved := savedBuf[:0]
+
+	sp := 0
+	for i := range p.code {
+		in := &p.code[i]
+		switch in.op {
+		case codeConst:
+			stack[sp] = in.value
+			sp++
+		case codeX:
+			stack[sp] = x
+			sp++
+		case codeY:
+			stack[sp] = y
+			sp++
+		case codeT:
+			stack[sp] = t
+			sp++
+		case codeAtan2:
+			stack[sp] = float32(math.Atan2(float64(y), float64(x)))
+			sp++
+		case codeWarp:
+			sp -= 2
+			saved = append(saved, [2]float32{x, y})
+			x, y = x+stack[sp], y+stack[sp+1]
+		case codeRotate:
+			sp--
+			saved = append(saved, [2]float32{x, y})
+			x, y = rotate(x, y, stack[sp])
+		case codeScale:
+			sp--
+			saved = append(saved, [2]float32{x, y})
+			x, y = x*stack[sp], y*stack[sp]
+		case codePolar:
+			saved = append(saved, [2]float32{x, y})
+			x, y = toPolar(x, y)
+		case codeRestore:
+			x, y = saved[len(saved)-1][0], saved[len(saved)-1][1]
+			saved = saved[:len(saved)-1]
+		case codeCall:
+			args := stack[sp-in.arity : sp]
+			sp -= in.arity
+			stack[sp] = in.fn(args)
+			sp++
+		case codePlus:
+			sp--
+			stack[sp-1] = stack[sp-1] + stack[sp]
+		case codeMinus:
+			sp--
+			stack[sp-1] = stack[sp-1] - stack[sp]
+		case codeMultiplies:
+			sp--
+			stack[sp-1] = stack[sp-1] * stack[sp]
+		case codeDivide:
+			sp--
+			if p.policy == Safe && stack[sp] == 0 {
+				stack[sp-1] = 0
+			} else {
+				stack[sp-1] = stack[sp-1] / stack[sp]
+			}
+		case codeNoise:
+			sp--
+			stack[sp-1] = float32(80*noise.Snoise2(stack[sp-1], stack[sp])) - 2.0
+		case codeAtan:
+			stack[sp-1] = float32(math.Atan(float64(stack[sp-1])))
+		case codeSin:
+			stack[sp-1] = float32(math.Sin(float64(stack[sp-1])))
+		case codeCos:
+			stack[sp-1] = float32(math.Cos(float64(stack[sp-1])))
+		case codeSquare:
+			stack[sp-1] = stack[sp-1] * stack[sp-1]
+		case codeNegate:
+			stack[sp-1] = -stack[sp-1]
+		case codeCeil:
+			stack[sp-1] = float32(math.Ceil(float64(stack[sp-1])))
+		case codeFloor:
+			stack[sp-1] = float32(math.Floor(float64(stack[sp-1])))
+		case codeAbs:
+			stack[sp-1] = float32(math.Abs(float64(stack[sp-1])))
+		}
+
+		if p.policy == Safe {
+			switch in.op {
+			case codeWarp, codeRotate, codeScale, codePolar:
+				x, y = finite(x), finite(y)
+			case codeRestore:
+			default:
+				stack[sp-1] = finite(stack[sp-1])
+			}
+		}
+	}
+	return stack[0]
+}
+
+// EvalRow runs the program over a whole scanline at once, one instruction at
+// a time, so the dispatch cost is paid per row instead of per pixel.
+func (p *Program) EvalRow(xs []float32, y float32, out []float32) {
+	p.EvalRowAt(xs, y, 0, out)
+}
+
+// EvalRowAt is EvalRow at time t.
+func (p *Program) EvalRowAt(xs []float32, y, t float32, out []float32) {
+	// the stack is evaluated into out at the bottom and scratch rows above
+	// it, the row out stands in for holds y and the rest the moved coordinates
+	s := getRows(p.stackSize+2*p.transforms, len(xs))
+	stack, moved := s.rows[:p.stackSize], s.rows[p.stackSize:]
+	yRow := stack[0]
+	stack[0] = out
+	defer func() {
+		stack[0] = yRow
+		s.release()
+	}()
+
+	// the coordinates only stay on one row until a transform moves them
+	cx, cy := xs, yRow
+	for j := range cy {
+		cy[j] = y
+	}
+	var savedBuf [8][2][]float32
+	saved := savedBuf[:0]
+
+	sp := 0
+	for i := range p.code {
+		in := &p.code[i]
+		switch in.op {
+		case codeConst:
+			row := stack[sp]
+			for j := range row {
+				row[j] = in.value
+			}
+			sp++
+		case codeX:
+			copy(stack[sp], cx)
+			sp++
+		case codeY:
+			copy(stack[sp], cy)
+			sp++
+		case codeT:
+			row := stack[sp]
+			for j := range row {
+				row[j] = t
+			}
+			sp++
+		case codeAtan2:
+			row := stack[sp]
+			for j := range row {
+				row[j] = float32(math.Atan2(float64(cy[j]), float64(cx[j])))
+			}
+			sp++
+		case codeWarp, codeRotate, codeScale, codePolar:
+			saved = append(saved, [2][]float32{cx, cy})
+			nx, ny := moved[0], moved[1]
+			moved = moved[2:]
+			switch in.op {
+			case codeWarp:
+				sp -= 2
+				dx, dy := stack[sp], stack[sp+1]
+				for j := range nx {
+					nx[j], ny[j] = cx[j]+dx[j], cy[j]+dy[j]
+				}
+			case codeRotate:
+				sp--
+				for j, angle := range stack[sp] {
+					nx[j], ny[j] = rotate(cx[j], cy[j], angle)
+				}
+			case codeScale:
+				sp--
+				for j, scale := range stack[sp] {
+					nx[j], ny[j] = cx[j]*scale, cy[j]*scale
+				}
+			case codePolar:
+				for j := range nx {
+					nx[j], ny[j] = toPolar(cx[j], cy[j])
+				}
+			}
+			cx, cy = nx, ny
+		case codeRestore:
+			cx, cy = saved[len(saved)-1][0], saved[len(saved)-1][1]
+			saved = saved[:len(saved)-1]
+		case codeCall:
+			sp -= in.arity
+			rows := stack[sp : sp+in.arity]
+			args := s.args[:in.arity]
+			// the result overwrites the first argument a point at a time,
+			// after it is read
+			result := stack[sp]
+			for j := range result {
+				for k := range rows {
+					args[k] = rows[k][j]
+				}
+				result[j] = in.fn(args)
+			}
+			sp++
+		case codePlus:
+			sp--
+			a, b := stack[sp-1], stack[sp]
+			for j := range a {
+				a[j] = a[j] + b[j]
+			}
+		case codeMinus:
+			sp--
+			a, b := stack[sp-1], stack[sp]
+			for j := range a {
+				a[j] = a[j] - b[j]
+			}
+		case codeMultiplies:
+			sp--
+			a, b := stack[sp-1], stack[sp]
+			for j := range a {
+				a[j] = a[j] * b[j]
+			}
+		case codeDivide:
+			sp--
+			a, b := stack[sp-1], stack[sp]
+			for j := range a {
+				if p.policy == Safe && b[j] == 0 {
+					a[j] = 0
+				} else {
+					a[j] = a[j] / b[j]
+				}
+			}
+		case codeNoise:
+			sp--
+			a, b := stack[sp-1], stack[sp]
+			for j := range a {
+				a[j] = float32(80*noise.Snoise2(a[j], b[j])) - 2.0
+			}
+		case codeAtan:
+			a := stack[sp-1]
+			for j := range a {
+				a[j] = float32(math.Atan(float64(a[j])))
+			}
+		case codeSin:
+			a := stack[sp-1]
+			for j := range a {
+				a[j] = float32(math.Sin(float64(a[j])))
+			}
+		case codeCos:
+			a := stack[sp-1]
+			for j := range a {
+				a[j] = float32(math.Cos(float64(a[j])))
+			}
+		case codeSquare:
+			a := stack[sp-1]
+			for j := range a {
+				a[j] = a[j] * a[j]
+			}
+		case codeNegate:
+			a := stack[sp-1]
+			for j := range a {
+				a[j] = -a[j]
+			}
+		case codeCeil:
+			a := stack[sp-1]
+			for j := range a {
+				a[j] = float32(math.Ceil(float64(a[j])))
+			}
+		case codeFloor:
+			a := stack[sp-1]
+			for j := range a {
+				a[j] = float32(math.Floor(float64(a[j])))
+			}
+		case codeAbs:
+			a := stack[sp-1]
+			for j := range a {
+				a[j] = float32(math.Abs(float64(a[j])))
+			}
+		}
+
+		if p.policy == Safe {
+			switch in.op {
+			case codeWarp, codeRotate, codeScale, codePolar:
+				// the moved coordinates are new rows, never xs
+				finiteRow(cx)
+				finiteRow(cy)
+			case codeRestore:
+			default:
+				finiteRow(stack[sp-1])
+			}
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package apt
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// randomTree grows a tree the way newPicture in main does.
+func randomTree(r *rand.Rand) Node {
+	node := GetRandomNodeOpt(r)
+	for i := r.Intn(20) + 10; i > 0; i-- {
+		node.AddRandom(GetRandomNodeOpt(r), r)
+	}
+	for node.AddLeaf(GetRandomLeafNode(r)) {
+	}
+	return node
+}
+
+// sameFloat reports whether a and b have the same bits, counting every NaN as
+// the same.
+func sameFloat(a, b float32) bool {
+	return math.Float32bits(a) == math.Float32bits(b) || (a != a && b != b)
+}
+
+// samplePoints are the x, y of a grid over -1 to 1.
+func samplePoints(n int) []float32 {
+	xs := make([]float32, n)
+	for i := range xs {
+		xs[i] = float32(i)/float32(n)*2 - 1
+	}
+	return xs
+}
+
+// mustCompile compiles node to follow policy, failing tb if it can't.
+func mustCompile(tb testing.TB, node Node, policy NumericPolicy) *Program {
+	tb.Helper()
+	p, err := CompileWith(node, policy)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return p
+}
+
+func TestCompileMatchesEval(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	xs := samplePoints(32)
+	row := make([]float32, len(xs))
+	for i := 0; i < 200; i++ {
+		tree := randomTree(r)
+		p := mustCompile(t, tree, Strict)
+		for _, y := range xs {
+			p.EvalRowAt(xs, y, 0, row)
+			for j, x := range xs {
+				want := tree.Eval(x, y)
+				if got := p.EvalAt(x, y, 0); !sameFloat(got, want) {
+					t.Fatalf("EvalAt(%v, %v) = %v, Eval gives %v, for %s", x, y, got, want, tree)
+				}
+				if !sameFloat(row[j], want) {
+					t.Fatalf("EvalRowAt at %v, %v = %v, Eval gives %v, for %s", x, y, row[j], want, tree)
+				}
+			}
+		}
+	}
+}
+
+func TestCompileSafe(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	xs := samplePoints(32)
+	row := make([]float32, len(xs))
+	nonFinite := 0
+	for i := 0; i < 200; i++ {
+		tree := randomTree(r)
+		strict, safe := mustCompile(t, tree, Strict), mustCompile(t, tree, Safe)
+		for _, y := range xs {
+			safe.EvalRowAt(xs, y, 0.5, row)
+			for j, x := range xs {
+				got := safe.EvalAt(x, y, 0.5)
+				if got != got || math.IsInf(float64(got), 0) {
+					t.Fatalf("Safe gives %v at %v, %v for %s", got, x, y, tree)
+				}
+				if !sameFloat(row[j], got) {
+					t.Fatalf("Safe EvalRowAt at %v, %v = %v, EvalAt gives %v, for %s", x, y, row[j], got, tree)
+				}
+				if v := strict.EvalAt(x, y, 0.5); v != v || math.IsInf(float64(v), 0) {
+					nonFinite++
+				}
+			}
+		}
+	}
+	if nonFinite == 0 {
+		t.Fatal("no tree was non-finite under Strict, so Safe wasn't tested")
+	}
+}
+
+func TestCompileRejectsOpaqueNodes(t *testing.T) {
+	// picture has no Eval in its spec, and the subtree it falls back to the
+	// tree walker for would only see time 0 and Strict
+	for _, src := range []string{
+		"( picture x y t )",
+		"( + x ( picture x y t ) )",
+		"( warp x y ( picture x y t ) )",
+	} {
+		tree, err := Parse(strings.NewReader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := CompileWith(tree, Safe); err == nil {
+			t.Errorf("compiled %s", src)
+		}
+	}
+}
+
+func TestEvalRowReusesRows(t *testing.T) {
+	xs := samplePoints(64)
+	out := make([]float32, len(xs))
+	for name, tree := range benchmarkTrees() {
+		p := mustCompile(t, tree, Strict)
+		// the first row fills the pool
+		tree.EvalRow(xs, 0.5, out)
+		if n := testing.AllocsPerRun(10, func() { tree.EvalRow(xs, 0.5, out) }); n != 0 {
+			t.Errorf("%s: the tree allocates %v times per row", name, n)
+		}
+		p.EvalRow(xs, 0.5, out)
+		if n := testing.AllocsPerRun(10, func() { p.EvalRow(xs, 0.5, out) }); n != 0 {
+			t.Errorf("%s: the program allocates %v times per row", name, n)
+		}
+	}
+}
+
+// benchmarkTrees are an operator on x and y leaves, for each operator random
+// generation picks from.
+func benchmarkTrees() map[string]Node {
+	trees := map[string]Node{}
+	for _, s := range specs {
+		if !s.pickable(false) {
+			continue
+		}
+		node := newNode(s)
+		if rn, ok := node.(randomizer); ok {
+			rn.randomize(rand.New(rand.NewSource(1)))
+		}
+		children := make([]Node, s.Arity)
+		for i := range children {
+			if i%2 == 0 {
+				children[i] = NewOpX()
+			} else {
+				children[i] = NewOpY()
+			}
+			children[i].SetParent(node)
+		}
+		node.SetChildren(children)
+		trees[s.Name] = node
+	}
+	trees["random"] = randomTree(rand.New(rand.NewSource(3)))
+	return trees
+}
+
+func BenchmarkTreeEval(b *testing.B) {
+	for name, tree := range benchmarkTrees() {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				tree.Eval(float32(i%64)/32-1, 0.25)
+			}
+		})
+	}
+}
+
+func BenchmarkProgramEval(b *testing.B) {
+	for name, tree := range benchmarkTrees() {
+		p := mustCompile(b, tree, Strict)
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				p.Eval(float32(i%64)/32-1, 0.25)
+			}
+		})
+	}
+}
+
+func BenchmarkTreeEvalRow(b *testing.B) {
+	xs, out := samplePoints(256), make([]float32, 256)
+	for name, tree := range benchmarkTrees() {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				tree.EvalRow(xs, 0.25, out)
+			}
+		})
+	}
+}
+
+func BenchmarkProgramEvalRow(b *testing.B) {
+	xs, out := samplePoints(256), make([]float32, 256)
+	for name, tree := range benchmarkTrees() {
+		p := mustCompile(b, tree, Strict)
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				p.EvalRow(xs, 0.25, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,362 @@
+package apt
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// Var names a coordinate to differentiate with respect to.
+type Var int
+
+const (
+	VarX Var = iota
+	VarY
+)
+
+// finiteStep is the distance finite differences look either side. It is a
+// power of two so moving the coordinates by it is exact.
+const finiteStep = 1.0 / 1024
+
+// Derive returns a new tree for the partial derivative of node with respect
+// to wrt. Operators with a known derivative are differentiated symbolically,
+// the noise operators and anything else by a central finite difference. The
+// result is simplified, and where node isn't differentiable, like at the
+// jumps of floor, it takes the derivative on either side.
+func Derive(node Node, wrt Var) Node {
+	return Simplify(derive(node, wrt))
+}
+
+func derive(node Node, wrt Var) Node {
+	switch n := node.(type) {
+	case *OpConst, *OpT:
+		return constNode(0)
+	case *OpX:
+		return oneIf(wrt == VarX)
+	case *OpY:
+		return oneIf(wrt == VarY)
+	case *OpAtan2:
+		// atan2 works on x and y rather than its children
+		r2 := add(build("square", NewOpX()), build("square", NewOpY()))
+		if wrt == VarX {
+			return div(neg(NewOpY()), r2)
+		}
+		return div(NewOpX(), r2)
+	case *OpDdx:
+		return derive(n.derived(), wrt)
+	case *OpDdy:
+		return derive(n.derived(), wrt)
+	case *OpWarp, *OpRotate, *OpScale, *OpPolar:
+		return deriveTransform(node, wrt)
+	}
+
+	c := node.GetChildren()
+	d := func(i int) Node { return derive(c[i], wrt) }
+	cp := func(i int) Node { return CopyTree(c[i], nil) }
+	switch node.(type) {
+	case *OpPlus:
+		return add(d(0), d(1))
+	case *OpMinus:
+		return sub(d(0), d(1))
+	case *OpMultiplies:
+		return add(mul(d(0), cp(1)), mul(cp(0), d(1)))
+	case *OpDivide:
+		return div(sub(mul(d(0), cp(1)), mul(cp(0), d(1))), build("square", cp(1)))
+	case *OpAtan:
+		return div(d(0), add(constNode(1), build("square", cp(0))))
+	case *OpSin:
+		return mul(build("cos", cp(0)), d(0))
+	case *OpCos:
+		return mul(neg(build("sin", cp(0))), d(0))
+	case *OpSquare:
+		return mul(mul(constNode(2), cp(0)), d(0))
+	case *OpNegate:
+		return neg(d(0))
+	case *OpCeil, *OpFloor, *OpStep:
+		return constNode(0)
+	case *OpAbs:
+		return mul(sign(cp(0)), d(0))
+	case *OpPow:
+		// safePow is |a|^b, and 0 at a = 0, where so is the second term
+		byExponent := mul(mul(build("pow", cp(0), cp(1)), build("log", cp(0))), d(1))
+		byBase := mul(mul(mul(cp(1), build("pow", cp(0), sub(cp(1), constNode(1)))), sign(cp(0))), d(0))
+		return add(byExponent, byBase)
+	case *OpMod:
+		return sub(d(0), mul(d(1), build("floor", div(cp(0), cp(1)))))
+	case *OpMin:
+		return mixOf(d(1), d(0), build("step", cp(0), cp(1)))
+	case *OpMax:
+		return mixOf(d(1), d(0), build("step", cp(1), cp(0)))
+	case *OpMix:
+		return add(mixOf(d(0), d(1), cp(2)), mul(sub(cp(1), cp(0)), d(2)))
+	case *OpClamp:
+		// clamp32 puts the bounds in order and then clamps
+		lo, hi := build("min", cp(1), cp(2)), build("max", cp(1), cp(2))
+		return derive(build("min", build("max", cp(0), lo), hi), wrt)
+	case *OpSmoothstep:
+		t := build("clamp", div(sub(cp(2), cp(0)), sub(cp(1), cp(0))), constNode(0), constNode(1))
+		return derive(mul(build("square", t), sub(constNode(3), mul(constNode(2), CopyTree(t, nil)))), wrt)
+	case *OpSqrt:
+		return div(mul(sign(cp(0)), d(0)), mul(constNode(2), build("sqrt", cp(0))))
+	case *OpLog:
+		return div(d(0), cp(0))
+	case *OpExp:
+		return mul(build("exp", cp(0)), d(0))
+	case *OpTan:
+		return mul(add(constNode(1), build("square", build("tan", cp(0)))), d(0))
+	}
+	return finiteDifference(node, wrt)
+}
+
+// finiteDifference estimates the derivative of node by evaluating it either
+// side of each point, moving the coordinates with warp.
+func finiteDifference(node Node, wrt Var) Node {
+	h, zero := constNode(finiteStep), constNode(0)
+	back, zero2 := constNode(-finiteStep), constNode(0)
+	var ahead, behind Node
+	if wrt == VarX {
+		ahead = build("warp", h, zero, CopyTree(node, nil))
+		behind = build("warp", back, zero2, CopyTree(node, nil))
+	} else {
+		ahead = build("warp", zero, h, CopyTree(node, nil))
+		behind = build("warp", zero2, back, CopyTree(node, nil))
+	}
+	return div(sub(ahead, behind), constNode(2*finiteStep))
+}
+
+// deriveTransform uses the chain rule on a transform, whose body sees the
+// coordinates u and v instead of x and y:
+//
+//	d/dw body(u, v) = body_u(u, v) du/dw + body_v(u, v) dv/dw
+//
+// body_u(u, v) is the derivative of the body moved by the same transform.
+func deriveTransform(node Node, wrt Var) Node {
+	c := node.GetChildren()
+	body := c[len(c)-1]
+	cp := func(i int) Node { return CopyTree(c[i], nil) }
+	x, y := func() Node { return NewOpX() }, func() Node { return NewOpY() }
+
+	var du, dv Node
+	switch node.(type) {
+	case *OpWarp:
+		// u = x + dx, v = y + dy
+		du = add(oneIf(wrt == VarX), derive(c[0], wrt))
+		dv = add(oneIf(wrt == VarY), derive(c[1], wrt))
+	case *OpScale:
+		// u = x s, v = y s
+		ds := derive(c[0], wrt)
+		du = add(mul(oneIf(wrt == VarX), cp(0)), mul(x(), ds))
+		dv = add(mul(oneIf(wrt == VarY), cp(0)), mul(y(), CopyTree(ds, nil)))
+	case *OpRotate:
+		// u = x cos a - y sin a, v = x sin a + y cos a
+		cos, sin := func() Node { return build("cos", cp(0)) }, func() Node { return build("sin", cp(0)) }
+		u := sub(mul(x(), cos()), mul(y(), sin()))
+		v := add(mul(x(), sin()), mul(y(), cos()))
+		da := derive(c[0], wrt)
+		if wrt == VarX {
+			du = sub(cos(), mul(v, da))
+			dv = add(sin(), mul(u, CopyTree(da, nil)))
+		} else {
+			du = sub(neg(sin()), mul(v, da))
+			dv = add(cos(), mul(u, CopyTree(da, nil)))
+		}
+	case *OpPolar:
+		// u = sqrt(x^2 + y^2), v = atan2(y, x) / pi
+		r2 := func() Node { return add(build("square", x()), build("square", y())) }
+		piR2 := func() Node { return mul(constNode(math.Pi), r2()) }
+		if wrt == VarX {
+			du = div(x(), build("sqrt", r2()))
+			dv = div(neg(y()), piR2())
+		} else {
+			du = div(y(), build("sqrt", r2()))
+			dv = div(x(), piR2())
+		}
+	}
+
+	moved := func(derived Node) Node {
+		if _, ok := derived.(*OpConst); ok {
+			return derived
+		}
+		children := make([]Node, len(c))
+		for i := range c[:len(c)-1] {
+			children[i] = cp(i)
+		}
+		children[len(c)-1] = derived
+		return build(nodeName(node), children...)
+	}
+	return add(mul(moved(derive(body, VarX)), du), mul(moved(derive(body, VarY)), dv))
+}
+
+// build makes a node for the operator called name, taking ownership of the
+// children.
+func build(name string, children ...Node) Node {
+	n, ok := newNodeNamed(name)
+	if !ok {
+		panic("apt: no operator " + name)
+	}
+	for i, child := range children {
+		child.SetParent(n)
+		n.GetChildren()[i] = child
+	}
+	return n
+}
+
+func constNode(v float32) Node {
+	c := NewOpConst()
+	c.value = v
+	return c
+}
+
+func oneIf(b bool) Node {
+	if b {
+		return constNode(1)
+	}
+	return constNode(0)
+}
+
+// The helpers below leave out terms that are 0 and factors that are 1. Unlike
+// Simplify they may, since a derivative that is 0 stays 0 however big the
+// other factor gets.
+
+func add(a, b Node) Node {
+	if isConstValue(a, 0) {
+		return b
+	}
+	if isConstValue(b, 0) {
+		return a
+	}
+	return build("+", a, b)
+}
+
+func sub(a, b Node) Node {
+	if isConstValue(b, 0) {
+		return a
+	}
+	if isConstValue(a, 0) {
+		return neg(b)
+	}
+	return build("-", a, b)
+}
+
+func mul(a, b Node) Node {
+	if isConstValue(a, 0) || isConstValue(b, 0) {
+		return constNode(0)
+	}
+	if isConstValue(a, 1) {
+		return b
+	}
+	if isConstValue(b, 1) {
+		return a
+	}
+	return build("*", a, b)
+}
+
+func div(a, b Node) Node {
+	if isConstValue(a, 0) {
+		return constNode(0)
+	}
+	if isConstValue(b, 1) {
+		return a
+	}
+	return build("/", a, b)
+}
+
+func neg(a Node) Node {
+	if isConstValue(a, 0) {
+		return a
+	}
+	return build("negate", a)
+}
+
+func mixOf(a, b, t Node) Node {
+	if isConstValue(a, 0) {
+		return mul(b, t)
+	}
+	if isConstValue(b, 0) {
+		return mul(a, sub(constNode(1), t))
+	}
+	return build("mix", a, b, t)
+}
+
+// sign is -1 below 0 and 1 from 0 on.
+func sign(a Node) Node {
+	return sub(mul(constNode(2), build("step", constNode(0), a)), constNode(1))
+}
+
+// treeVersion counts the changes made to trees in place, by ReplaceNode,
+// Mutate, SetChildren, AddRandom and AddLeaf. Derivatives compare their child
+// against the copy they were worked out from only once it has moved on, rather
+// than at every point.
+var treeVersion uint64
+
+func treeChanged() {
+	atomic.AddUint64(&treeVersion, 1)
+}
+
+// derivative is shared by ddx and ddy, which evaluate the derivative of their
+// child. The child can be changed underneath it, by crossover or mutation
+// anywhere below, so the derivative is kept along with a copy of the child it
+// was worked out from and worked out again once the child no longer matches.
+type derivative struct {
+	BaseNode
+	name string
+	wrt  Var
+
+	mu    sync.Mutex
+	cache atomic.Value // *derivedCache
+}
+
+// derivedCache is the derivative of source, still current while treeVersion
+// is version.
+type derivedCache struct {
+	version uint64
+	source  Node
+	tree    Node
+}
+
+func (op *derivative) derived() Node {
+	version := atomic.LoadUint64(&treeVersion)
+	if c, _ := op.cache.Load().(*derivedCache); c != nil && c.version == version {
+		return c.tree
+	}
+
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	c, _ := op.cache.Load().(*derivedCache)
+	if c == nil || !equalTrees(op.Children[0], c.source) {
+		c = &derivedCache{source: CopyTree(op.Children[0], nil), tree: Derive(op.Children[0], op.wrt)}
+	} else {
+		c = &derivedCache{source: c.source, tree: c.tree}
+	}
+	c.version = version
+	op.cache.Store(c)
+	return c.tree
+}
+
+func (op *derivative) Eval(x, y float32) float32 {
+	return op.derived().Eval(x, y)
+}
+
+func (op *derivative) EvalRow(xs []float32, y float32, out []float32) {
+	op.derived().EvalRow(xs, y, out)
+}
+
+func (op *derivative) String() string {
+	return "( " + op.name + " " + op.Children[0].String() + " )"
+}
+
+type OpDdx struct {
+	derivative
+}
+
+func NewOpDdx() *OpDdx {
+	return &OpDdx{derivative{BaseNode: BaseNode{nil, make([]Node, 1)}, name: "ddx", wrt: VarX}}
+}
+
+type OpDdy struct {
+	derivative
+}
+
+func NewOpDdy() *OpDdy {
+	return &OpDdy{derivative{BaseNode: BaseNode{nil, make([]Node, 1)}, name: "ddy", wrt: VarY}}
+}
@@ -0,0 +1,26 @@
+package apt
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDerivativeFollowsChild(t *testing.T) {
+	node, err := Parse(strings.NewReader("( ddx ( + 1 ( * x x ) ) )"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := node.Eval(0.25, 0.5); v != 0.5 {
+		t.Fatalf("d/dx x*x at 0.25 = %v, want 0.5", v)
+	}
+
+	// a change below the child, not of the child itself
+	product := node.GetChildren()[0].GetChildren()[1]
+	ReplaceNode(product.GetChildren()[1], NewOpY())
+	if v := node.Eval(0.25, 0.5); v != 0.5 {
+		t.Fatalf("d/dx x*y at y = 0.5 is %v, want 0.5", v)
+	}
+	if v := node.Eval(0.25, 0.75); v != 0.75 {
+		t.Fatalf("d/dx x*y at y = 0.75 is %v, want 0.75", v)
+	}
+}
@@ -0,0 +1,140 @@
+package apt
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Path locates a node by the index of the child taken at each level down from
+// the root.
+type Path []int
+
+// String writes p like /1/0, the root is /.
+func (p Path) String() string {
+	if len(p) == 0 {
+		return "/"
+	}
+	var sb strings.Builder
+	for _, i := range p {
+		sb.WriteString("/" + strconv.Itoa(i))
+	}
+	return sb.String()
+}
+
+// Find returns the node p leads to from root, or false if p goes past a
+// leaf.
+func (p Path) Find(root Node) (Node, bool) {
+	node := root
+	for _, i := range p {
+		children := node.GetChildren()
+		if i < 0 || i >= len(children) {
+			return nil, false
+		}
+		node = children[i]
+	}
+	return node, true
+}
+
+type ChangeKind int
+
+const (
+	// Inserted is a node put above a subtree that was already there.
+	Inserted ChangeKind = iota
+	// Deleted is a node taken out from above one of its children.
+	Deleted
+	// Replaced is a subtree swapped for another.
+	Replaced
+	// ConstChanged is a constant that took another value.
+	ConstChanged
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case Inserted:
+		return "inserted"
+	case Deleted:
+		return "deleted"
+	case Replaced:
+		return "replaced"
+	case ConstChanged:
+		return "constant changed"
+	}
+	return "ChangeKind(" + strconv.Itoa(int(k)) + ")"
+}
+
+// Change is a difference Diff found, at Path in both trees. Old is the
+// subtree there in the first tree and New the one in the second. For an
+// insertion Old is child Kept of New, and for a deletion New is child Kept
+// of Old.
+type Change struct {
+	Kind     ChangeKind
+	Path     Path
+	Old, New Node
+	Kept     int
+}
+
+func (c Change) String() string {
+	switch c.Kind {
+	case Inserted:
+		return c.Path.String() + ": inserted " + nodeHead(c.New) + " above " + c.Old.String()
+	case Deleted:
+		return c.Path.String() + ": deleted " + nodeHead(c.Old) + " above " + c.New.String()
+	}
+	return c.Path.String() + ": " + c.Kind.String() + " " + c.Old.String() + " to " + c.New.String()
+}
+
+// Diff returns the changes that turn a into b, in the order their paths come
+// in the trees. It walks both trees together as long as the operators
+// match, so a subtree that moved shows up as changes in both places.
+func Diff(a, b Node) []Change {
+	var changes []Change
+	diff(a, b, nil, &changes)
+	return changes
+}
+
+func diff(a, b Node, path Path, changes *[]Change) {
+	if equalTrees(a, b) {
+		return
+	}
+	// the path is shared with the other changes, they each get a copy
+	at := append(Path(nil), path...)
+	_, aConst := a.(*OpConst)
+	_, bConst := b.(*OpConst)
+	switch {
+	case aConst && bConst:
+		*changes = append(*changes, Change{ConstChanged, at, a, b, 0})
+		return
+	case sameOperator(a, b):
+		bChildren := b.GetChildren()
+		for i, child := range a.GetChildren() {
+			diff(child, bChildren[i], append(path, i), changes)
+		}
+		return
+	}
+	for i, child := range b.GetChildren() {
+		if equalTrees(a, child) {
+			*changes = append(*changes, Change{Inserted, at, a, b, i})
+			return
+		}
+	}
+	for i, child := range a.GetChildren() {
+		if equalTrees(child, b) {
+			*changes = append(*changes, Change{Deleted, at, a, b, i})
+			return
+		}
+	}
+	*changes = append(*changes, Change{Replaced, at, a, b, 0})
+}
+
+// sameOperator reports whether a and b are the same operator with the same
+// parameters, so only their children can differ.
+func sameOperator(a, b Node) bool {
+	s := specOf(a)
+	if s == nil || s != specOf(b) || len(a.GetChildren()) != len(b.GetChildren()) {
+		return false
+	}
+	if pa, ok := a.(ParamNode); ok {
+		return strings.Join(pa.Params(), " ") == strings.Join(b.(ParamNode).Params(), " ")
+	}
+	return true
+}
@@ -0,0 +1,57 @@
+package apt
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	for _, test := range []struct {
+		a, b    string
+		changes []string
+	}{
+		{"( + x ( sin y ) )", "( + x ( sin y ) )", nil},
+		{"( + x ( sin y ) )", "( + x ( sin t ) )", []string{"/1/0: replaced y to t"}},
+		{"( + x 0.5 )", "( + x 0.25 )", []string{"/1: constant changed 0.500000000 to 0.250000000"}},
+		{"( + x y )", "( + ( abs x ) y )", []string{"/0: inserted abs above x"}},
+		{"( + ( abs x ) y )", "( + x y )", []string{"/0: deleted abs above x"}},
+		{"( * x y )", "( * y x )", []string{"/0: replaced x to y", "/1: replaced y to x"}},
+		{"( worleyf1 1 x y )", "( worleyf1 2 x y )", []string{"/: replaced ( worleyf1 1 x y ) to ( worleyf1 2 x y )"}},
+	} {
+		a, err := Parse(strings.NewReader(test.a))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := Parse(strings.NewReader(test.b))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		changes := Diff(a, b)
+		var got []string
+		for _, c := range changes {
+			got = append(got, c.String())
+			// the path leads to the changed subtrees in both trees
+			if n, ok := c.Path.Find(a); !ok || n != c.Old {
+				t.Errorf("%s: %v doesn't lead to %s in %s", test.a, c.Path, c.Old, test.a)
+			}
+			if n, ok := c.Path.Find(b); !ok || n != c.New {
+				t.Errorf("%s: %v doesn't lead to %s in %s", test.b, c.Path, c.New, test.b)
+			}
+		}
+		if strings.Join(got, "\n") != strings.Join(test.changes, "\n") {
+			t.Errorf("Diff(%s, %s) =\n%s\nwant\n%s", test.a, test.b, strings.Join(got, "\n"), strings.Join(test.changes, "\n"))
+		}
+	}
+}
+
+func TestDiffOfCopyIsEmpty(t *testing.T) {
+	r := rand.New(rand.NewSource(7))
+	for i := 0; i < 100; i++ {
+		tree := randomTree(r)
+		if changes := Diff(tree, CopyTree(tree, nil)); len(changes) != 0 {
+			t.Fatalf("a copy of %s differs: %v", tree, changes)
+		}
+	}
+}
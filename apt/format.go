@@ -0,0 +1,104 @@
+package apt
+
+import (
+	"strconv"
+	"strings"
+)
+
+type FormatOptions struct {
+	// Width is the longest a line may get before a subtree is broken up
+	// over several lines.
+	Width int
+	// Indent is written once per level of nesting.
+	Indent string
+	// Precision is the number of digits written after the decimal point of
+	// a constant. Constants that would read back as a different float32 at
+	// that precision are written with as many digits as they need instead.
+	Precision int
+}
+
+var DefaultFormatOptions = FormatOptions{Width: 80, Indent: "  ", Precision: 9}
+
+// Format pretty prints node. Subtrees that fit within opts.Width are kept on
+// one line, longer ones put each child on its own, further indented line.
+// Parsing the output gives back exactly the same tree.
+func Format(node Node, opts FormatOptions) string {
+	var sb strings.Builder
+	f := formatter{opts}
+	f.write(&sb, node, 0)
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+type formatter struct {
+	opts FormatOptions
+}
+
+func (f formatter) write(sb *strings.Builder, node Node, depth int) {
+	indent := strings.Repeat(f.opts.Indent, depth)
+	children := node.GetChildren()
+	if flat, ok := f.flat(node, f.opts.Width-len(indent)); ok || len(children) == 0 {
+		sb.WriteString(indent + flat)
+		return
+	}
+
+	sb.WriteString(indent + "( " + nodeHead(node))
+	for _, child := range children {
+		sb.WriteString("\n")
+		f.write(sb, child, depth+1)
+	}
+	sb.WriteString(" )")
+}
+
+// flat writes node on one line and reports whether that took at most width
+// bytes. It stops once the line is too long, so a deep tree isn't written out
+// in full at every level of it. Leaves are always written in full.
+func (f formatter) flat(node Node, width int) (string, bool) {
+	var sb strings.Builder
+	ok := f.writeFlat(&sb, node, width)
+	return sb.String(), ok
+}
+
+func (f formatter) writeFlat(sb *strings.Builder, node Node, width int) bool {
+	children := node.GetChildren()
+	if c, ok := node.(*OpConst); ok {
+		sb.WriteString(f.constant(c.value))
+	} else if len(children) == 0 {
+		sb.WriteString(nodeName(node))
+	} else {
+		sb.WriteString("( " + nodeHead(node))
+		for _, child := range children {
+			sb.WriteString(" ")
+			if sb.Len() > width || !f.writeFlat(sb, child, width) {
+				return false
+			}
+		}
+		sb.WriteString(" )")
+	}
+	return sb.Len() <= width
+}
+
+func (f formatter) constant(v float32) string {
+	s := strconv.FormatFloat(float64(v), 'f', f.opts.Precision, 32)
+	if parsed, err := strconv.ParseFloat(s, 32); err != nil || float32(parsed) != v {
+		s = strconv.FormatFloat(float64(v), 'f', -1, 32)
+	}
+	return s
+}
+
+// nodeHead returns the name of node followed by its parameters, if it has
+// any.
+func nodeHead(node Node) string {
+	if pn, ok := node.(ParamNode); ok {
+		return nodeName(node) + " " + strings.Join(pn.Params(), " ")
+	}
+	return nodeName(node)
+}
+
+// nodeName returns the name node is written as.
+func nodeName(node Node) string {
+	if s := specOf(node); s != nil {
+		return s.Name
+	}
+	return node.String()
+}
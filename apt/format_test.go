@@ -0,0 +1,60 @@
+package apt
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestFormatRoundTrip(t *testing.T) {
+	trees := []Node{}
+	r := rand.New(rand.NewSource(4))
+	for i := 0; i < 300; i++ {
+		trees = append(trees, randomTree(r))
+	}
+	// constants that don't fit in the default precision
+	for _, v := range []float32{1e-12, math.MaxFloat32, math.SmallestNonzeroFloat32, float32(math.Copysign(0, -1)), 1.0 / 3} {
+		trees = append(trees, build("+", constNode(v), NewOpX()))
+	}
+
+	withTestImages(func() {
+		for _, src := range glslPictures {
+			tree, err := Parse(strings.NewReader(src))
+			if err != nil {
+				t.Fatal(err)
+			}
+			trees = append(trees, tree)
+		}
+
+		for _, opts := range []FormatOptions{
+			DefaultFormatOptions,
+			{Width: 0, Indent: "\t", Precision: 0},
+			{Width: 40, Indent: " ", Precision: 3},
+		} {
+			for _, tree := range trees {
+				formatted := Format(tree, opts)
+				parsed, err := Parse(strings.NewReader(formatted))
+				if err != nil {
+					t.Fatalf("%v\n%s", err, formatted)
+				}
+				if !equalTrees(parsed, tree) {
+					t.Fatalf("reads back as\n%s\nnot\n%s", parsed, tree)
+				}
+			}
+		}
+	})
+}
+
+func TestFormatDeepTree(t *testing.T) {
+	// every level used to write out its whole subtree to see if it fit
+	src := strings.Repeat("( sin ", 5000) + "x" + strings.Repeat(" )", 5000)
+	tree, err := Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	formatted := Format(tree, DefaultFormatOptions)
+	if parsed, err := Parse(strings.NewReader(formatted)); err != nil || !equalTrees(parsed, tree) {
+		t.Fatalf("the deep tree doesn't read back: %v", err)
+	}
+}
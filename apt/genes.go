@@ -0,0 +1,42 @@
+package apt
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// genes is the gene bank, subtrees worth reusing by name.
+var genes = map[string]Node{}
+
+// GeneProbability is how likely RandomGene is to draw a gene, when there are
+// any. Mutate uses it too, so good motifs turn up again in new pictures.
+var GeneProbability = 0.1
+
+// RegisterGene adds a copy of node to the gene bank under name, replacing any
+// gene of that name.
+func RegisterGene(name string, node Node) {
+	genes[name] = CopyTree(node, nil)
+}
+
+// Genes returns the names of the genes in the bank, sorted.
+func Genes() []string {
+	names := make([]string, 0, len(genes))
+	for name := range genes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RandomGene draws a gene with GeneProbability, returning its name and a copy
+// to be put in a tree, or nil if it didn't draw one. It takes nothing from r
+// while the bank is empty, so the pictures of a seed only change once there
+// are genes.
+func RandomGene(r *rand.Rand) (string, Node) {
+	if len(genes) == 0 || GeneProbability <= 0 || r.Float64() >= GeneProbability {
+		return "", nil
+	}
+	names := Genes()
+	name := names[r.Intn(len(names))]
+	return name, CopyTree(genes[name], nil)
+}
@@ -0,0 +1,508 @@
+package apt
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/ahmadfarhanstwn/noise"
+)
+
+// GLSL turns the channels of a picture into a self-contained GLSL 3.30
+// fragment shader. x and y run from -1 to 1 across the viewport with y going
+// down, like in the renderer, and the time t comes from the time uniform. The
+// shader brings its own copies of the noise functions, so it draws the same
+// picture up to float precision, but clamps values outside [-1, 1] where the
+// renderer wraps them around.
+//
+// Each image the picture samples becomes a sampler2D uniform, image0 and up,
+// named in a comment next to it. They are expected to have their first row at
+// texture coordinate 0 and to repeat or clamp like the image was loaded.
+func GLSL(r, g, b Node) (string, error) {
+	w := &glslWriter{images: map[string]string{}}
+	var channels [3]string
+	for i, node := range []Node{r, g, b} {
+		v, err := w.expr(node, "x", "y")
+		if err != nil {
+			return "", err
+		}
+		channels[i] = v
+	}
+
+	var sb strings.Builder
+	sb.WriteString("#version 330 core\n\n")
+	sb.WriteString("// Generated by evolving-pictures.\n\n")
+	sb.WriteString("uniform vec2 resolution;\n")
+	sb.WriteString("uniform float time;\n")
+	for i, name := range w.imageNames {
+		fmt.Fprintf(&sb, "uniform sampler2D image%d; // %s\n", i, strconv.Quote(name))
+	}
+	sb.WriteString("\nout vec4 fragColor;\n\n")
+	sb.WriteString(glslPerm())
+	sb.WriteString(glslLibrary)
+	sb.WriteString("\nvoid main() {\n")
+	// pixel (0, 0) is at the top left in the renderer, and the coordinates
+	// are those of the corner of the pixel
+	sb.WriteString("\tfloat x = (gl_FragCoord.x - 0.5) / resolution.x * 2.0 - 1.0;\n")
+	sb.WriteString("\tfloat y = 1.0 - (gl_FragCoord.y + 0.5) / resolution.y * 2.0;\n")
+	sb.WriteString(w.body.String())
+	fmt.Fprintf(&sb, "\tfragColor = vec4(clamp(vec3(%s, %s, %s) * 0.5 + 0.5, 0.0, 1.0), 1.0);\n", channels[0], channels[1], channels[2])
+	sb.WriteString("}\n")
+	return sb.String(), nil
+}
+
+type glslWriter struct {
+	body strings.Builder
+	vars int
+	// images maps the images sampled, without their channel, to their
+	// uniforms
+	images     map[string]string
+	imageNames []string
+}
+
+// let declares a new variable holding the value of expr and returns its
+// name.
+func (w *glslWriter) let(expr string) string {
+	name := "v" + strconv.Itoa(w.vars)
+	w.vars++
+	fmt.Fprintf(&w.body, "\tfloat %s = %s;\n", name, expr)
+	return name
+}
+
+// expr writes out the statements computing node at the coordinates in the
+// variables x and y, and returns an expression for its value.
+func (w *glslWriter) expr(node Node, x, y string) (string, error) {
+	switch n := node.(type) {
+	case *OpConst:
+		return glslFloat(n.value), nil
+	case *OpX:
+		return x, nil
+	case *OpY:
+		return y, nil
+	case *OpT:
+		return "time", nil
+	case *OpAtan2:
+		return w.let("atan(" + y + ", " + x + ")"), nil
+	case *OpDdx:
+		return w.expr(n.derived(), x, y)
+	case *OpDdy:
+		return w.expr(n.derived(), x, y)
+	case *OpWarp, *OpRotate, *OpScale, *OpPolar:
+		return w.transform(node, x, y)
+	}
+
+	children := node.GetChildren()
+	args := make([]string, len(children))
+	for i, child := range children {
+		arg, err := w.expr(child, x, y)
+		if err != nil {
+			return "", err
+		}
+		args[i] = arg
+	}
+	call := func(f string) string {
+		return f + "(" + strings.Join(args, ", ") + ")"
+	}
+
+	switch n := node.(type) {
+	case *OpPlus:
+		return w.let(args[0] + " + " + args[1]), nil
+	case *OpMinus:
+		return w.let(args[0] + " - " + args[1]), nil
+	case *OpMultiplies:
+		return w.let(args[0] + " * " + args[1]), nil
+	case *OpDivide:
+		return w.let(args[0] + " / " + args[1]), nil
+	case *OpSquare:
+		return w.let(args[0] + " * " + args[0]), nil
+	case *OpNegate:
+		return w.let("-" + args[0]), nil
+	case *opNoise:
+		return w.let("80.0 * " + call("snoise2") + " - 2.0"), nil
+	case *OpAtan:
+		return w.let(call("atan")), nil
+	case *OpSin:
+		return w.let(call("sin")), nil
+	case *OpCos:
+		return w.let(call("cos")), nil
+	case *OpCeil:
+		return w.let(call("ceil")), nil
+	case *OpFloor:
+		return w.let(call("floor")), nil
+	case *OpAbs:
+		return w.let(call("abs")), nil
+	case *OpFbm:
+		return w.let(call("fbm")), nil
+	case *OpTurbulence:
+		return w.let(call("turbulence")), nil
+	case *OpPow:
+		return w.let(call("safePow")), nil
+	case *OpMod:
+		return w.let(call("safeMod")), nil
+	case *OpMin:
+		return w.let(call("min")), nil
+	case *OpMax:
+		return w.let(call("max")), nil
+	case *OpStep:
+		return w.let(call("step")), nil
+	case *OpMix:
+		return w.let(call("mix")), nil
+	case *OpClamp:
+		return w.let(call("clamp32")), nil
+	case *OpSmoothstep:
+		return w.let(call("smoothstep32")), nil
+	case *OpSqrt:
+		return w.let(call("safeSqrt")), nil
+	case *OpLog:
+		return w.let(call("safeLog")), nil
+	case *OpExp:
+		return w.let(call("exp32")), nil
+	case *OpTan:
+		return w.let(call("tan32")), nil
+	case *OpWorleyF1:
+		return w.let(n.glslCall("worleyF1", args)), nil
+	case *OpWorleyF2:
+		return w.let(n.glslCall("worleyF2", args)), nil
+	case *OpWorleyEdge:
+		return w.let(n.glslCall("worleyEdge", args)), nil
+	case *OpValueNoise:
+		return w.let(n.glslCall("valueNoise", args)), nil
+	case *OpRidged:
+		return w.let(n.glslCall("ridged", args)), nil
+	case *OpImage:
+		return w.let(w.sample(n.name, args)), nil
+	}
+	return "", fmt.Errorf("can't export %s to GLSL", nodeName(node))
+}
+
+// transform declares the moved coordinates and writes out the body at them.
+func (w *glslWriter) transform(node Node, x, y string) (string, error) {
+	children := node.GetChildren()
+	args := make([]string, len(children)-1)
+	for i, child := range children[:len(children)-1] {
+		arg, err := w.expr(child, x, y)
+		if err != nil {
+			return "", err
+		}
+		args[i] = arg
+	}
+
+	var mx, my string
+	switch node.(type) {
+	case *OpWarp:
+		mx, my = x+" + "+args[0], y+" + "+args[1]
+	case *OpRotate:
+		sin, cos := w.let("sin("+args[0]+")"), w.let("cos("+args[0]+")")
+		mx, my = x+" * "+cos+" - "+y+" * "+sin, x+" * "+sin+" + "+y+" * "+cos
+	case *OpScale:
+		mx, my = x+" * "+args[0], y+" * "+args[0]
+	case *OpPolar:
+		mx, my = "length(vec2("+x+", "+y+"))", "atan("+y+", "+x+") / "+glslFloat(math.Pi)
+	}
+	return w.expr(children[len(children)-1], w.let(mx), w.let(my))
+}
+
+// sample reads one channel of an image, name.r, name.g and name.b being the
+// color channels of name and name itself its brightness.
+func (w *glslWriter) sample(name string, args []string) string {
+	base, swizzle := name, ""
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		if c := name[i+1:]; c == "r" || c == "g" || c == "b" {
+			base, swizzle = name[:i], c
+		}
+	}
+	if _, ok := bitmaps[base]; !ok {
+		// an image whose own name ends in .r, say
+		base, swizzle = name, ""
+	}
+	uniform, ok := w.images[base]
+	if !ok {
+		uniform = "image" + strconv.Itoa(len(w.imageNames))
+		w.images[base] = uniform
+		w.imageNames = append(w.imageNames, base)
+	}
+	texel := "texture(" + uniform + ", vec2(" + args[0] + ", " + args[1] + ") * 0.5 + 0.5)"
+	if swizzle == "" {
+		return "dot(" + texel + ".rgb, vec3(0.299, 0.587, 0.114)) * 2.0 - 1.0"
+	}
+	return texel + "." + swizzle + " * 2.0 - 1.0"
+}
+
+func (op *seededNoise) glslCall(f string, args []string) string {
+	return f + "(" + strconv.FormatUint(uint64(op.seed), 10) + "u, " + args[0] + ", " + args[1] + ")"
+}
+
+// glslFloat writes v as a GLSL float literal.
+func glslFloat(v float32) string {
+	switch {
+	case math.IsNaN(float64(v)):
+		return "uintBitsToFloat(0x7fc00000u)"
+	case math.IsInf(float64(v), 1):
+		return "uintBitsToFloat(0x7f800000u)"
+	case math.IsInf(float64(v), -1):
+		return "uintBitsToFloat(0xff800000u)"
+	}
+	s := strconv.FormatFloat(float64(v), 'g', -1, 32)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	if math.Signbit(float64(v)) {
+		return "(" + s + ")"
+	}
+	return s
+}
+
+// glslPerm is the permutation table of the noise package as a GLSL array.
+func glslPerm() string {
+	var sb strings.Builder
+	sb.WriteString("const int perm[256] = int[256](")
+	for i, p := range noise.Perm {
+		if i%16 == 0 {
+			sb.WriteString("\n\t")
+		} else {
+			sb.WriteString(" ")
+		}
+		sb.WriteString(strconv.Itoa(int(p)))
+		if i < len(noise.Perm)-1 {
+			sb.WriteString(",")
+		}
+	}
+	sb.WriteString(");\n")
+	return sb.String()
+}
+
+// glslLibrary has the GLSL versions of the functions the operators use,
+// following the Go ones line by line.
+var glslLibrary = `
+int fastFloor(float x) {
+	int i = int(x);
+	return float(i) <= x ? i : i - 1;
+}
+
+float grad2(int hash, float x, float y) {
+	int h = hash & 7;
+	float u = y;
+	float v = 2.0 * x;
+	if (h < 4) {
+		u = x;
+		v = 2.0 * y;
+	}
+	if ((h & 1) != 0) {
+		u = -u;
+	}
+	if ((h & 2) != 0) {
+		v = -v;
+	}
+	return u + v;
+}
+
+float snoise2(float x, float y) {
+	const float F2 = 0.366025403;
+	const float G2 = 0.211324865;
+	float s = (x + y) * F2;
+	int i = fastFloor(x + s);
+	int j = fastFloor(y + s);
+	float t = float(i + j) * G2;
+	float x0 = x - (float(i) - t);
+	float y0 = y - (float(j) - t);
+	int i1 = 0;
+	int j1 = 1;
+	if (x0 > y0) {
+		i1 = 1;
+		j1 = 0;
+	}
+	float x1 = x0 - float(i1) + G2;
+	float y1 = y0 - float(j1) + G2;
+	float x2 = x0 - 1.0 + 2.0 * G2;
+	float y2 = y0 - 1.0 + 2.0 * G2;
+	int ii = i & 255;
+	int jj = j & 255;
+
+	float n0 = 0.0;
+	float n1 = 0.0;
+	float n2 = 0.0;
+	float t0 = 0.5 - x0 * x0 - y0 * y0;
+	if (t0 >= 0.0) {
+		t0 *= t0;
+		n0 = t0 * t0 * grad2(perm[(ii + perm[jj]) & 255], x0, y0);
+	}
+	float t1 = 0.5 - x1 * x1 - y1 * y1;
+	if (t1 >= 0.0) {
+		t1 *= t1;
+		n1 = t1 * t1 * grad2(perm[(ii + i1 + perm[(jj + j1) & 255]) & 255], x1, y1);
+	}
+	float t2 = 0.5 - x2 * x2 - y2 * y2;
+	if (t2 >= 0.0) {
+		t2 *= t2;
+		n2 = t2 * t2 * grad2(perm[(ii + 1 + perm[(jj + 1) & 255]) & 255], x2, y2);
+	}
+	return n0 + n1 + n2;
+}
+
+int octaveCount(float v) {
+	if (!(v >= 1.0)) {
+		return 1;
+	}
+	if (v >= ` + strconv.Itoa(maxOctaves) + `.0) {
+		return ` + strconv.Itoa(maxOctaves) + `;
+	}
+	return int(v + 0.5);
+}
+
+float fbm(float x, float y, float frequency, float gain, float lacunarity, float octaves) {
+	int n = octaveCount(octaves);
+	float sum = 0.0;
+	float amplitude = 1.0;
+	for (int i = 0; i < n; i++) {
+		sum += snoise2(x * frequency, y * frequency) * amplitude;
+		frequency *= lacunarity;
+		amplitude *= gain;
+	}
+	return sum;
+}
+
+float turbulence(float x, float y, float frequency, float gain, float lacunarity, float octaves) {
+	int n = octaveCount(octaves);
+	float sum = 0.0;
+	float amplitude = 1.0;
+	for (int i = 0; i < n; i++) {
+		sum += abs(snoise2(x * frequency, y * frequency) * amplitude);
+		frequency *= lacunarity;
+		amplitude *= gain;
+	}
+	return sum;
+}
+
+uint hash2(int ix, int iy, uint seed) {
+	uint h = seed ^ uint(ix) * 0x27d4eb2du ^ uint(iy) * 0x165667b1u;
+	h ^= h >> 15;
+	h *= 0x85ebca6bu;
+	h ^= h >> 13;
+	h *= 0xc2b2ae35u;
+	h ^= h >> 16;
+	return h;
+}
+
+float unitFloat(uint h) {
+	return float(h >> 8) / 16777216.0;
+}
+
+void lattice(float v, out int i, out float f) {
+	v = clamp(v, -1073741824.0, 1073741824.0);
+	float fl = floor(v);
+	i = int(fl);
+	f = v - fl;
+}
+
+vec2 worley(uint seed, float x, float y) {
+	if (isnan(x) || isnan(y)) {
+		return vec2(x + y);
+	}
+	int ix, iy;
+	float fx, fy;
+	lattice(x, ix, fx);
+	lattice(y, iy, fy);
+	float f1 = uintBitsToFloat(0x7f800000u);
+	float f2 = f1;
+	for (int dy = -1; dy <= 1; dy++) {
+		for (int dx = -1; dx <= 1; dx++) {
+			uint h = hash2(ix + dx, iy + dy, seed);
+			float px = float(dx) + unitFloat(h) - fx;
+			float py = float(dy) + unitFloat(hash2(ix + dx, iy + dy, h)) - fy;
+			float d = sqrt(px * px + py * py);
+			if (d < f1) {
+				f2 = f1;
+				f1 = d;
+			} else if (d < f2) {
+				f2 = d;
+			}
+		}
+	}
+	return vec2(f1, f2);
+}
+
+float worleyF1(uint seed, float x, float y) {
+	return worley(seed, x, y).x * 2.0 - 1.0;
+}
+
+float worleyF2(uint seed, float x, float y) {
+	return worley(seed, x, y).y * 2.0 - 1.0;
+}
+
+float worleyEdge(uint seed, float x, float y) {
+	vec2 f = worley(seed, x, y);
+	return (f.y - f.x) * 2.0 - 1.0;
+}
+
+float latticeValue(int ix, int iy, uint seed) {
+	return unitFloat(hash2(ix, iy, seed)) * 2.0 - 1.0;
+}
+
+float valueNoise(uint seed, float x, float y) {
+	int ix, iy;
+	float fx, fy;
+	lattice(x, ix, fx);
+	lattice(y, iy, fy);
+	float sx = fx * fx * (3.0 - 2.0 * fx);
+	float sy = fy * fy * (3.0 - 2.0 * fy);
+	float top = latticeValue(ix, iy, seed) + (latticeValue(ix + 1, iy, seed) - latticeValue(ix, iy, seed)) * sx;
+	float bottom = latticeValue(ix, iy + 1, seed) + (latticeValue(ix + 1, iy + 1, seed) - latticeValue(ix, iy + 1, seed)) * sx;
+	return top + (bottom - top) * sy;
+}
+
+float ridged(uint seed, float x, float y) {
+	float ox = unitFloat(hash2(0, 0, seed)) * 256.0;
+	float oy = unitFloat(hash2(1, 0, seed)) * 256.0;
+	float result = 0.0;
+	float weight = 1.0;
+	float amplitude = 1.0;
+	for (int i = 0; i < 4; i++) {
+		float n = 40.0 * snoise2(x + ox, y + oy);
+		float signal = 1.0 - abs(n);
+		signal *= signal * weight;
+		result += signal * amplitude;
+		weight = clamp(signal * 2.0, 0.0, 1.0);
+		x *= 2.0;
+		y *= 2.0;
+		amplitude /= 2.0;
+	}
+	return result - 1.0;
+}
+
+float safePow(float a, float b) {
+	return a == 0.0 ? 0.0 : min(pow(abs(a), b), 3.40282347e38);
+}
+
+float safeMod(float a, float b) {
+	return b == 0.0 ? 0.0 : a - b * floor(a / b);
+}
+
+float clamp32(float v, float lo, float hi) {
+	return clamp(v, min(lo, hi), max(lo, hi));
+}
+
+float smoothstep32(float e0, float e1, float a) {
+	if (e0 == e1) {
+		return step(e0, a);
+	}
+	float t = clamp((a - e0) / (e1 - e0), 0.0, 1.0);
+	return t * t * (3.0 - 2.0 * t);
+}
+
+float safeSqrt(float a) {
+	return sqrt(abs(a));
+}
+
+float safeLog(float a) {
+	return a == 0.0 ? 0.0 : log(abs(a));
+}
+
+float exp32(float a) {
+	return min(exp(a), 3.40282347e38);
+}
+
+float tan32(float a) {
+	return clamp(tan(a), -` + glslFloat(tanLimit) + `, ` + glslFloat(tanLimit) + `);
+}
+`
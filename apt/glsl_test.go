@@ -0,0 +1,73 @@
+package apt
+
+import (
+	"flag"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// glslPictures are the pictures with golden shaders in testdata, by file
+// name.
+var glslPictures = map[string]string{
+	"noise":      `( picture ( snoise2 x y ) ( * ( snoise2 ( * x 3 ) y ) t ) ( negate ( snoise2 y ( / x 0 ) ) ) )`,
+	"cellnoise":  `( picture ( worleyf1 7 x y ) ( - ( worleyf2 8 x y ) ( worleyf2f1 9 y x ) ) ( + ( valuenoise 10 x t ) ( ridged 11 ( * x 2 ) y ) ) )`,
+	"transforms": `( picture ( warp ( sin y ) ( cos x ) ( * x y ) ) ( rotate ( * t 0.5 ) ( scale 2 ( snoise2 x y ) ) ) ( polar ( + x ( square y ) ) ) )`,
+	"image":      `( picture ( image "photo.r" x y ) ( image "photo.g" ( negate y ) x ) ( * ( image "photo" x y ) ( image "tile" ( * x 4 ) y ) ) )`,
+	"math":       `( picture ( exp ( * x 100 ) ) ( tan ( * y 2 ) ) ( + ( pow 10 ( * x 100 ) ) ( clamp ( log y ) ( sqrt x ) ( max x t ) ) ) )`,
+	"fbm":        `( picture ( fbm x y 2 0.5 2 4 ) ( turbulence x y ( abs t ) 0.6 2.1 ( * x 8 ) ) ( mix ( fbm y x 1 0.5 2 12 ) ( pow x y ) ( smoothstep 0 1 ( mod x 0.3 ) ) ) )`,
+}
+
+// withTestImages registers the images the golden pictures sample while f
+// runs, so the other tests don't see them.
+func withTestImages(f func()) {
+	photo := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	photo.Set(1, 0, color.RGBA{255, 0, 0, 255})
+	photo.Set(0, 1, color.RGBA{0, 255, 128, 255})
+	RegisterImage("photo", photo, EdgeClamp)
+	RegisterImage("tile", photo, EdgeWrap)
+	defer func() {
+		for _, name := range []string{"photo", "tile"} {
+			for _, suffix := range []string{"", ".r", ".g", ".b"} {
+				delete(bitmaps, name+suffix)
+			}
+		}
+	}()
+	f()
+}
+
+func TestGLSLGolden(t *testing.T) {
+	withTestImages(func() {
+		for name, src := range glslPictures {
+			picture, err := Parse(strings.NewReader(src))
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			channels := picture.GetChildren()
+			shader, err := GLSL(channels[0], channels[1], channels[2])
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+
+			golden := filepath.Join("testdata", name+".frag")
+			if *update {
+				if err := os.WriteFile(golden, []byte(shader), 0644); err != nil {
+					t.Fatal(err)
+				}
+				continue
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v, run go test -update to write it", err)
+			}
+			if shader != string(want) {
+				t.Errorf("the shader for %s differs from %s, run go test -update if the change is intended", name, golden)
+			}
+		}
+	})
+}
@@ -0,0 +1,433 @@
+package apt
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// GenerateGo writes the source of a Go file in package pkg with a function
+// called funcName, of type func(x, y float32) (r, g, b float32), that gives
+// exactly what calling Eval on the channels of picture, an OpPict, gives, on
+// every platform.
+// Every operator is inlined, so nothing but the noise package is needed to
+// draw it. The time t is 0, like in Eval, and images can't be generated.
+//
+// The helpers the function needs are written along with it, named after it
+// so that several generated pictures can share a package.
+func GenerateGo(picture Node, pkg, funcName string) ([]byte, error) {
+	if _, ok := picture.(*OpPict); !ok {
+		return nil, fmt.Errorf("expected a ( picture r g b ) tree, got %s", nodeName(picture))
+	}
+	if funcName == "" {
+		return nil, fmt.Errorf("no function name")
+	}
+
+	g := &goWriter{helpers: map[string]bool{}, consts: map[uint32]string{}}
+	var channels [3]string
+	for i, child := range picture.GetChildren() {
+		expr, err := g.expr(child)
+		if err != nil {
+			return nil, err
+		}
+		channels[i] = expr
+	}
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "// %s returns the channels of a picture at x and y, which are usually between\n", funcName)
+	fmt.Fprintf(&body, "// -1 and 1, as values that are usually between -1 and 1 too.\n")
+	fmt.Fprintf(&body, "func %s(x, y float32) (r, g, b float32) {\n", funcName)
+	for i, v := range g.values {
+		fmt.Fprintf(&body, "c%d := %s\n", i, goFloat(v))
+	}
+	fmt.Fprintf(&body, "r = %s\n", channels[0])
+	fmt.Fprintf(&body, "g = %s\n", channels[1])
+	fmt.Fprintf(&body, "b = %s\n", channels[2])
+	fmt.Fprintf(&body, "return r, g, b\n}\n")
+
+	names := make([]string, 0, len(g.helpers))
+	for name := range g.helpers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		body.WriteString("\n" + goHelpers[name].src + "\n")
+	}
+	prefix := strings.ToLower(funcName[:1]) + funcName[1:]
+	code := strings.Replace(body.String(), "$", prefix, -1)
+
+	var src bytes.Buffer
+	src.WriteString("// Code generated by evolving-pictures. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&src, "package %s\n\n", pkg)
+	var imports []string
+	if strings.Contains(code, "math.") {
+		imports = append(imports, `"math"`)
+	}
+	if strings.Contains(code, "noise.") {
+		if len(imports) > 0 {
+			imports = append(imports, "")
+		}
+		imports = append(imports, `"github.com/ahmadfarhanstwn/noise"`)
+	}
+	if len(imports) > 0 {
+		src.WriteString("import (\n" + strings.Join(imports, "\n") + "\n)\n\n")
+	}
+	src.WriteString(code)
+	return format.Source(src.Bytes())
+}
+
+type goWriter struct {
+	helpers map[string]bool
+	// the constants are kept in variables, so that Go doesn't work out
+	// expressions of them at compile time, with more precision than at
+	// run time, or reject them for dividing by zero
+	values []float32
+	consts map[uint32]string
+}
+
+// constant returns the variable holding v.
+func (g *goWriter) constant(v float32) string {
+	bits := math.Float32bits(v)
+	if name, ok := g.consts[bits]; ok {
+		return name
+	}
+	name := "c" + strconv.Itoa(len(g.values))
+	g.values = append(g.values, v)
+	g.consts[bits] = name
+	return name
+}
+
+// use makes sure the helper called name, and the ones it calls, are written
+// out, and returns its name in the generated code.
+func (g *goWriter) use(name string) string {
+	if !g.helpers[name] {
+		g.helpers[name] = true
+		for _, dep := range goHelpers[name].deps {
+			g.use(dep)
+		}
+	}
+	return "$" + name
+}
+
+// expr returns a Go expression for the value of node at x and y.
+func (g *goWriter) expr(node Node) (string, error) {
+	switch n := node.(type) {
+	case *OpConst:
+		return g.constant(n.value), nil
+	case *OpX:
+		return "x", nil
+	case *OpY:
+		return "y", nil
+	case *OpT:
+		return g.constant(0), nil
+	case *OpAtan2:
+		return "float32(math.Atan2(float64(y), float64(x)))", nil
+	case *OpDdx:
+		return g.expr(n.derived())
+	case *OpDdy:
+		return g.expr(n.derived())
+	}
+
+	children := node.GetChildren()
+	args := make([]string, len(children))
+	for i, child := range children {
+		arg, err := g.expr(child)
+		if err != nil {
+			return "", err
+		}
+		args[i] = arg
+	}
+	// every result is converted explicitly, which rounds it to float32 and
+	// keeps the compiler from fusing a product and a sum into a multiply-add
+	// the tree walker doesn't do
+	call := func(helper string) string {
+		return "float32(" + g.use(helper) + "(" + strings.Join(args, ", ") + "))"
+	}
+	binary := func(op string) string {
+		return "float32(" + args[0] + " " + op + " " + args[1] + ")"
+	}
+	math64 := func(f string) string {
+		return "float32(math." + f + "(float64(" + args[0] + ")))"
+	}
+	// the transforms evaluate their body in a function literal, called with
+	// the moved coordinates
+	at := func(coords string) string {
+		return "func(x, y float32) float32 { return " + args[len(args)-1] + " }(" + coords + ")"
+	}
+
+	switch n := node.(type) {
+	case *OpPlus:
+		return binary("+"), nil
+	case *OpMinus:
+		return binary("-"), nil
+	case *OpMultiplies:
+		return binary("*"), nil
+	case *OpDivide:
+		return binary("/"), nil
+	case *OpNegate:
+		return "(-" + args[0] + ")", nil
+	case *OpSquare:
+		return call("Square"), nil
+	case *OpAtan:
+		return math64("Atan"), nil
+	case *OpSin:
+		return math64("Sin"), nil
+	case *OpCos:
+		return math64("Cos"), nil
+	case *OpCeil:
+		return math64("Ceil"), nil
+	case *OpFloor:
+		return math64("Floor"), nil
+	case *OpAbs:
+		return math64("Abs"), nil
+	case *opNoise:
+		return "float32(float32(80*noise.Snoise2(" + args[0] + ", " + args[1] + ")) - 2.0)", nil
+	case *OpFbm:
+		return call("Fbm"), nil
+	case *OpTurbulence:
+		return call("Turbulence"), nil
+	case *OpPow:
+		return call("SafePow"), nil
+	case *OpMod:
+		return call("SafeMod"), nil
+	case *OpMin:
+		return call("Min32"), nil
+	case *OpMax:
+		return call("Max32"), nil
+	case *OpStep:
+		return call("Step"), nil
+	case *OpMix:
+		return call("Mix"), nil
+	case *OpClamp:
+		return call("Clamp32"), nil
+	case *OpSmoothstep:
+		return call("Smoothstep"), nil
+	case *OpSqrt:
+		return call("SafeSqrt"), nil
+	case *OpLog:
+		return call("SafeLog"), nil
+	case *OpExp:
+		return call("Exp32"), nil
+	case *OpTan:
+		return call("Tan32"), nil
+	case *OpWorleyF1:
+		return n.goCall(g.use("WorleyF1"), args), nil
+	case *OpWorleyF2:
+		return n.goCall(g.use("WorleyF2"), args), nil
+	case *OpWorleyEdge:
+		return n.goCall(g.use("WorleyEdge"), args), nil
+	case *OpValueNoise:
+		return n.goCall(g.use("ValueNoise"), args), nil
+	case *OpRidged:
+		return n.goCall(g.use("Ridged"), args), nil
+	case *OpWarp:
+		return at("x+" + args[0] + ", y+" + args[1]), nil
+	case *OpRotate:
+		return at(g.use("Rotate") + "(x, y, " + args[0] + ")"), nil
+	case *OpScale:
+		return at(g.use("Scale") + "(x, y, " + args[0] + ")"), nil
+	case *OpPolar:
+		return at(g.use("ToPolar") + "(x, y)"), nil
+	}
+	return "", fmt.Errorf("can't generate Go for %s", nodeName(node))
+}
+
+func (op *seededNoise) goCall(f string, args []string) string {
+	return f + "(" + strconv.FormatUint(uint64(op.seed), 10) + ", " + args[0] + ", " + args[1] + ")"
+}
+
+// goFloat writes v as a float32 expression.
+func goFloat(v float32) string {
+	switch {
+	case math.IsNaN(float64(v)):
+		return "float32(math.NaN())"
+	case math.IsInf(float64(v), 0):
+		return "float32(math.Inf(" + strconv.Itoa(int(math.Copysign(1, float64(v)))) + "))"
+	case v == 0 && math.Signbit(float64(v)):
+		// constants can't be negative zero
+		return "float32(math.Copysign(0, -1))"
+	}
+	return "float32(" + strconv.FormatFloat(float64(v), 'g', -1, 32) + ")"
+}
+
+// goHelpers are the functions the generated code calls, copied from the
+// ones the nodes use. $ stands for the prefix that keeps their names apart
+// from those of other generated pictures.
+var goHelpers = map[string]struct {
+	deps []string
+	src  string
+}{
+	"Square": {nil, `func $Square(a float32) float32 {
+	return a * a
+}`},
+	"OctaveCount": {nil, `func $OctaveCount(v float32) int {
+	if !(v >= 1) {
+		return 1
+	}
+	if v >= ` + strconv.Itoa(maxOctaves) + ` {
+		return ` + strconv.Itoa(maxOctaves) + `
+	}
+	return int(v + 0.5)
+}`},
+	"Fbm": {[]string{"OctaveCount"}, `func $Fbm(x, y, frequency, gain, lacunarity, octaves float32) float32 {
+	return noise.Fbm2(x, y, frequency, gain, lacunarity, $OctaveCount(octaves))
+}`},
+	"Turbulence": {[]string{"OctaveCount"}, `func $Turbulence(x, y, frequency, gain, lacunarity, octaves float32) float32 {
+	return noise.Turbulence(x, y, frequency, gain, lacunarity, $OctaveCount(octaves))
+}`},
+	"SafePow": {nil, `func $SafePow(a, b float32) float32 {
+	if a == 0 {
+		return 0
+	}
+	return float32(math.Min(math.Pow(math.Abs(float64(a)), float64(b)), math.MaxFloat32))
+}`},
+	"SafeMod": {nil, `func $SafeMod(a, b float32) float32 {
+	if b == 0 {
+		return 0
+	}
+	return float32(float64(a) - float64(float64(b)*math.Floor(float64(a)/float64(b))))
+}`},
+	"Min32": {nil, `func $Min32(a, b float32) float32 {
+	if b < a {
+		return b
+	}
+	return a
+}`},
+	"Max32": {nil, `func $Max32(a, b float32) float32 {
+	if b > a {
+		return b
+	}
+	return a
+}`},
+	"Step": {nil, `func $Step(edge, a float32) float32 {
+	if a < edge {
+		return 0
+	}
+	return 1
+}`},
+	"Mix": {nil, `func $Mix(a, b, t float32) float32 {
+	return float32(a*(1-t)) + float32(b*t)
+}`},
+	"Clamp32": {[]string{"Min32", "Max32"}, `func $Clamp32(v, lo, hi float32) float32 {
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+	return $Min32($Max32(v, lo), hi)
+}`},
+	"Smoothstep": {[]string{"Step", "Clamp32"}, `func $Smoothstep(e0, e1, a float32) float32 {
+	if e0 == e1 {
+		return $Step(e0, a)
+	}
+	t := $Clamp32((a-e0)/(e1-e0), 0, 1)
+	return float32(t * t * (3 - float32(2*t)))
+}`},
+	"SafeSqrt": {nil, `func $SafeSqrt(a float32) float32 {
+	return float32(math.Sqrt(math.Abs(float64(a))))
+}`},
+	"SafeLog": {nil, `func $SafeLog(a float32) float32 {
+	if a == 0 {
+		return 0
+	}
+	return float32(math.Log(math.Abs(float64(a))))
+}`},
+	"Exp32": {nil, `func $Exp32(a float32) float32 {
+	return float32(math.Min(math.Exp(float64(a)), math.MaxFloat32))
+}`},
+	"Tan32": {nil, `func $Tan32(a float32) float32 {
+	return float32(math.Max(-` + strconv.FormatFloat(tanLimit, 'g', -1, 64) + `, math.Min(` + strconv.FormatFloat(tanLimit, 'g', -1, 64) + `, math.Tan(float64(a)))))
+}`},
+	"Rotate": {nil, `func $Rotate(x, y, angle float32) (float32, float32) {
+	sin, cos := math.Sincos(float64(angle))
+	return float32(float64(float64(x)*cos) - float64(float64(y)*sin)), float32(float64(float64(x)*sin) + float64(float64(y)*cos))
+}`},
+	"Scale": {nil, `func $Scale(x, y, s float32) (float32, float32) {
+	return float32(x * s), float32(y * s)
+}`},
+	"ToPolar": {nil, `func $ToPolar(x, y float32) (float32, float32) {
+	return float32(math.Hypot(float64(x), float64(y))), float32(math.Atan2(float64(y), float64(x)) / math.Pi)
+}`},
+	"Hash2": {nil, `func $Hash2(ix, iy int32, seed uint32) uint32 {
+	h := seed ^ uint32(ix)*0x27d4eb2d ^ uint32(iy)*0x165667b1
+	h ^= h >> 15
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}`},
+	"UnitFloat": {nil, `func $UnitFloat(h uint32) float64 {
+	return float64(float64(h>>8) / (1 << 24))
+}`},
+	"Lattice": {nil, `func $Lattice(v float64) (int32, float64) {
+	v = math.Max(-1<<30, math.Min(1<<30, v))
+	f := math.Floor(v)
+	return int32(f), v - f
+}`},
+	"Worley": {[]string{"Hash2", "UnitFloat", "Lattice"}, `func $Worley(seed uint32, x, y float32) (f1, f2 float64) {
+	if x != x || y != y {
+		return math.NaN(), math.NaN()
+	}
+	ix, fx := $Lattice(float64(x))
+	iy, fy := $Lattice(float64(y))
+	f1, f2 = math.Inf(1), math.Inf(1)
+	for dy := int32(-1); dy <= 1; dy++ {
+		for dx := int32(-1); dx <= 1; dx++ {
+			h := $Hash2(ix+dx, iy+dy, seed)
+			px := float64(dx) + $UnitFloat(h) - fx
+			py := float64(dy) + $UnitFloat($Hash2(ix+dx, iy+dy, h)) - fy
+			d := math.Sqrt(float64(px*px) + float64(py*py))
+			if d < f1 {
+				f1, f2 = d, f1
+			} else if d < f2 {
+				f2 = d
+			}
+		}
+	}
+	return f1, f2
+}`},
+	"WorleyF1": {[]string{"Worley"}, `func $WorleyF1(seed uint32, x, y float32) float32 {
+	f1, _ := $Worley(seed, x, y)
+	return float32(float64(f1*2) - 1)
+}`},
+	"WorleyF2": {[]string{"Worley"}, `func $WorleyF2(seed uint32, x, y float32) float32 {
+	_, f2 := $Worley(seed, x, y)
+	return float32(float64(f2*2) - 1)
+}`},
+	"WorleyEdge": {[]string{"Worley"}, `func $WorleyEdge(seed uint32, x, y float32) float32 {
+	f1, f2 := $Worley(seed, x, y)
+	return float32(float64((f2-f1)*2) - 1)
+}`},
+	"ValueNoise": {[]string{"Hash2", "UnitFloat", "Lattice"}, `func $ValueNoise(seed uint32, x, y float32) float32 {
+	ix, fx := $Lattice(float64(x))
+	iy, fy := $Lattice(float64(y))
+	value := func(dx, dy int32) float64 {
+		return float64($UnitFloat($Hash2(ix+dx, iy+dy, seed))*2) - 1
+	}
+	sx := fx * fx * (3 - float64(2*fx))
+	sy := fy * fy * (3 - float64(2*fy))
+	top := value(0, 0) + float64((value(1, 0)-value(0, 0))*sx)
+	bottom := value(0, 1) + float64((value(1, 1)-value(0, 1))*sx)
+	return float32(top + float64((bottom-top)*sy))
+}`},
+	"Ridged": {[]string{"Hash2", "UnitFloat"}, `func $Ridged(seed uint32, x, y float32) float32 {
+	const octaves, lacunarity, gain, offset = 4, 2.0, 2.0, 1.0
+	ox := float32($UnitFloat($Hash2(0, 0, seed)) * 256)
+	oy := float32($UnitFloat($Hash2(1, 0, seed)) * 256)
+
+	var result, weight, amplitude float64 = 0, 1, 1
+	for i := 0; i < octaves; i++ {
+		n := float64(40 * noise.Snoise2(x+ox, y+oy))
+		signal := offset - math.Abs(n)
+		signal = float64(signal * signal * weight)
+		result += float64(signal * amplitude)
+		weight = math.Max(0, math.Min(1, signal*gain))
+		x, y = x*lacunarity, y*lacunarity
+		amplitude /= lacunarity
+	}
+	return float32(result - 1)
+}`},
+}
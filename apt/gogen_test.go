@@ -0,0 +1,131 @@
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/importer"
+	goparser "go/parser"
+	gotoken "go/token"
+	"go/types"
+	"math"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// generatedMain prints the bits of x, y and each picture's channels there,
+// over a grid, one point to a line.
+const generatedMain = `package main
+
+import (
+	"fmt"
+	"math"
+)
+
+func main() {
+	for i, picture := range pictures {
+		for yi := 0; yi < 16; yi++ {
+			for xi := 0; xi < 16; xi++ {
+				x, y := float32(xi-8)/8, float32(yi-8)/8
+				r, g, b := picture(x, y)
+				fmt.Println(i, math.Float32bits(x), math.Float32bits(y), math.Float32bits(r), math.Float32bits(g), math.Float32bits(b))
+			}
+		}
+	}
+}
+`
+
+func TestGenerateGo(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds and runs the generated code")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go command to run the generated code with")
+	}
+
+	r := rand.New(rand.NewSource(4))
+	var pictures []Node
+	for i := 0; i < 40; i++ {
+		picture := NewOpPict()
+		for c := range picture.Children {
+			picture.Children[c] = randomTree(r)
+			picture.Children[c].SetParent(picture)
+		}
+		pictures = append(pictures, picture)
+	}
+
+	// the directory is in the module, so the noise package resolves, and
+	// starts with _ so ./... leaves it alone
+	dir, err := os.MkdirTemp(".", "_gogen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fset := gotoken.NewFileSet()
+	var files []*ast.File
+	var table strings.Builder
+	table.WriteString("package main\n\nvar pictures = []func(x, y float32) (r, g, b float32){\n")
+	write := func(name string, src []byte) {
+		if err := os.WriteFile(filepath.Join(dir, name), src, 0644); err != nil {
+			t.Fatal(err)
+		}
+		file, err := goparser.ParseFile(fset, name, src, 0)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		files = append(files, file)
+	}
+	for i, picture := range pictures {
+		funcName := "Picture" + strconv.Itoa(i)
+		src, err := GenerateGo(picture, "main", funcName)
+		if err != nil {
+			t.Fatalf("%s: %v", picture, err)
+		}
+		write(strings.ToLower(funcName)+".go", src)
+		table.WriteString(funcName + ",\n")
+	}
+	table.WriteString("}\n")
+	write("pictures.go", []byte(table.String()))
+	write("main.go", []byte(generatedMain))
+
+	conf := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+	if _, err := conf.Check("main", fset, files, nil); err != nil {
+		t.Fatalf("generated code doesn't type check: %v", err)
+	}
+
+	cmd := exec.Command(goTool, "run", "./"+filepath.Base(dir))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("running the generated code: %v\n%s", err, stderr.Bytes())
+	}
+	points := 0
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		var i int
+		var bits [5]uint32
+		if _, err := fmt.Sscan(scanner.Text(), &i, &bits[0], &bits[1], &bits[2], &bits[3], &bits[4]); err != nil {
+			t.Fatalf("bad output %q: %v", scanner.Text(), err)
+		}
+		x, y := math.Float32frombits(bits[0]), math.Float32frombits(bits[1])
+		for c, channel := range pictures[i].GetChildren() {
+			got, want := math.Float32frombits(bits[2+c]), channel.Eval(x, y)
+			if !sameFloat(got, want) {
+				t.Fatalf("generated code gives %v at %v, %v, Eval gives %v, for %s", got, x, y, want, channel)
+			}
+		}
+		points++
+	}
+	if points != len(pictures)*16*16 {
+		t.Fatalf("generated code printed %d points, want %d", points, len(pictures)*16*16)
+	}
+}
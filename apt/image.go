@@ -0,0 +1,171 @@
+package apt
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+)
+
+type EdgeMode int
+
+const (
+	// EdgeClamp repeats the pixels on the border outside the image
+	EdgeClamp EdgeMode = iota
+	// EdgeWrap tiles the image
+	EdgeWrap
+)
+
+// Bitmap is one channel of an image, ready to be sampled by OpImage.
+type Bitmap struct {
+	w, h int
+	pix  []float32
+	mode EdgeMode
+}
+
+var bitmaps = map[string]*Bitmap{}
+
+// RegisterImage makes img available to ( image "name" u v ) nodes. name
+// samples its brightness and name.r, name.g and name.b its color channels.
+func RegisterImage(name string, img image.Image, mode EdgeMode) {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	channels := [4]*Bitmap{}
+	for i := range channels {
+		channels[i] = &Bitmap{w, h, make([]float32, w*h), mode}
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			rf, gf, bf := float32(r)/0xffff, float32(g)/0xffff, float32(b)/0xffff
+			i := y*w + x
+			channels[0].pix[i] = float32(0.299*rf) + float32(0.587*gf) + float32(0.114*bf)
+			channels[1].pix[i] = rf
+			channels[2].pix[i] = gf
+			channels[3].pix[i] = bf
+		}
+	}
+	bitmaps[name] = channels[0]
+	bitmaps[name+".r"] = channels[1]
+	bitmaps[name+".g"] = channels[2]
+	bitmaps[name+".b"] = channels[3]
+}
+
+// Images returns the names that image nodes can sample, sorted.
+func Images() []string {
+	names := make([]string, 0, len(bitmaps))
+	for name := range bitmaps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (b *Bitmap) pixel(x, y int) float32 {
+	if b.mode == EdgeWrap {
+		x = ((x % b.w) + b.w) % b.w
+		y = ((y % b.h) + b.h) % b.h
+	} else {
+		x = clampInt(x, 0, b.w-1)
+		y = clampInt(y, 0, b.h-1)
+	}
+	return b.pix[y*b.w+x]
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	} else if v > max {
+		return max
+	}
+	return v
+}
+
+// Sample filters the bitmap bilinearly at u, v, which go from -1 to 1 across
+// the image like x and y do across a picture. The result is from -1 to 1
+// too.
+func (b *Bitmap) Sample(u, v float32) float32 {
+	if b == nil || b.w == 0 || b.h == 0 || math.IsNaN(float64(u)) || math.IsNaN(float64(v)) {
+		return 0
+	}
+	fx := float64(float64((u+1)/2)*float64(b.w)) - 0.5
+	fy := float64(float64((v+1)/2)*float64(b.h)) - 0.5
+	// keep far away points from overflowing int, they all end up on the edge
+	// or somewhere in a tile anyway
+	fx = math.Max(-1<<30, math.Min(1<<30, fx))
+	fy = math.Max(-1<<30, math.Min(1<<30, fy))
+	x0, y0 := math.Floor(fx), math.Floor(fy)
+	tx, ty := float32(fx-x0), float32(fy-y0)
+	ix, iy := int(x0), int(y0)
+
+	// the conversions keep the products from being fused, like in math.go
+	top := float32(b.pixel(ix, iy)*(1-tx)) + float32(b.pixel(ix+1, iy)*tx)
+	bottom := float32(b.pixel(ix, iy+1)*(1-tx)) + float32(b.pixel(ix+1, iy+1)*tx)
+	return float32((float32(top*(1-ty))+float32(bottom*ty))*2) - 1
+}
+
+type OpImage struct {
+	BaseNode
+	name   string
+	bitmap *Bitmap
+}
+
+// NewOpImage makes an image node for the first of the registered images.
+func NewOpImage() *OpImage {
+	op := &OpImage{BaseNode: BaseNode{nil, make([]Node, 2)}}
+	if names := Images(); len(names) > 0 {
+		op.name = names[0]
+		op.bitmap = bitmaps[op.name]
+	}
+	return op
+}
+
+// randomize switches to one of the registered images, picked at random.
+func (op *OpImage) randomize(r *rand.Rand) {
+	if names := Images(); len(names) > 0 {
+		op.name = names[r.Intn(len(names))]
+		op.bitmap = bitmaps[op.name]
+	}
+}
+
+func (op *OpImage) Params() []string {
+	return []string{strconv.Quote(op.name)}
+}
+
+func (op *OpImage) SetParams(params []string) error {
+	name, err := strconv.Unquote(params[0])
+	if err != nil {
+		return fmt.Errorf("image name %s is not a quoted string", params[0])
+	}
+	bitmap, ok := bitmaps[name]
+	if !ok {
+		return fmt.Errorf("no image called %q, loaded images are %v", name, Images())
+	}
+	op.name, op.bitmap = name, bitmap
+	return nil
+}
+
+func (op *OpImage) apply(args []float32) float32 {
+	return op.bitmap.Sample(args[0], args[1])
+}
+
+func (op *OpImage) Eval(x, y float32) float32 {
+	return op.bitmap.Sample(op.Children[0].Eval(x, y), op.Children[1].Eval(x, y))
+}
+
+func (op *OpImage) EvalRow(xs []float32, y float32, out []float32) {
+	s := getRows(1, len(xs))
+	defer s.release()
+	b := s.rows[0]
+	op.Children[0].EvalRow(xs, y, out)
+	op.Children[1].EvalRow(xs, y, b)
+	for i := range out {
+		out[i] = op.bitmap.Sample(out[i], b[i])
+	}
+}
+
+func (op *OpImage) String() string {
+	return "( image " + strconv.Quote(op.name) + " " + op.Children[0].String() + " " + op.Children[1].String() + " )"
+}
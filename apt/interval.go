@@ -0,0 +1,269 @@
+package apt
+
+import "math"
+
+// Interval is a closed range of values, from Min up to Max.
+type Interval struct {
+	Min, Max float32
+}
+
+// Unbounded is the interval of every value, for results nothing is known
+// about.
+var Unbounded = Interval{float32(math.Inf(-1)), float32(math.Inf(1))}
+
+// Finite reports whether both ends of i are finite numbers.
+func (i Interval) Finite() bool {
+	return !math.IsInf(float64(i.Min), 0) && !math.IsInf(float64(i.Max), 0) &&
+		!math.IsNaN(float64(i.Min)) && !math.IsNaN(float64(i.Max))
+}
+
+// Contains reports whether v lies within i.
+func (i Interval) Contains(v float32) bool {
+	return i.Min <= v && v <= i.Max
+}
+
+// Range returns an interval holding every value node takes for x in xRange
+// and y in yRange, at time 0 like Eval. The bounds are safe but not always
+// tight, and NaN is not tracked: they hold where no part of node is NaN, since
+// min, max and clamp can turn a NaN into a number outside them.
+func Range(node Node, xRange, yRange Interval) Interval {
+	return RangeAt(node, xRange, yRange, Interval{0, 0})
+}
+
+// RangeAt is Range for t in tRange.
+func RangeAt(node Node, xRange, yRange, tRange Interval) Interval {
+	switch n := node.(type) {
+	case *OpConst:
+		return Interval{n.value, n.value}
+	case *OpX:
+		return xRange
+	case *OpY:
+		return yRange
+	case *OpT:
+		return tRange
+	case *OpAtan2:
+		return Interval{-math.Pi, math.Pi}
+	case *OpDdx:
+		return RangeAt(n.derived(), xRange, yRange, tRange)
+	case *OpDdy:
+		return RangeAt(n.derived(), xRange, yRange, tRange)
+	}
+
+	children := node.GetChildren()
+	switch node.(type) {
+	case *OpWarp:
+		dx := RangeAt(children[0], xRange, yRange, tRange)
+		dy := RangeAt(children[1], xRange, yRange, tRange)
+		return RangeAt(children[2], addRange(xRange, dx), addRange(yRange, dy), tRange)
+	case *OpRotate:
+		// any rotation stays within the circle through the furthest corner
+		r := radius(xRange, yRange)
+		return RangeAt(children[1], Interval{-r, r}, Interval{-r, r}, tRange)
+	case *OpScale:
+		s := RangeAt(children[0], xRange, yRange, tRange)
+		return RangeAt(children[1], mulRange(xRange, s), mulRange(yRange, s), tRange)
+	case *OpPolar:
+		return RangeAt(children[0], Interval{0, radius(xRange, yRange)}, Interval{-1, 1}, tRange)
+	}
+
+	s := specOf(node)
+	if s == nil || s.Range == nil {
+		return Unbounded
+	}
+	args := make([]Interval, len(children))
+	for i, child := range children {
+		args[i] = RangeAt(child, xRange, yRange, tRange)
+	}
+	return s.Range(args)
+}
+
+// radius is the distance from the origin to the furthest point of the
+// rectangle.
+func radius(xRange, yRange Interval) float32 {
+	x := math.Max(math.Abs(float64(xRange.Min)), math.Abs(float64(xRange.Max)))
+	y := math.Max(math.Abs(float64(yRange.Min)), math.Abs(float64(yRange.Max)))
+	return float32(math.Hypot(x, y))
+}
+
+// hull is the smallest interval holding all of vs, or Unbounded if one of
+// them is NaN.
+func hull(vs ...float32) Interval {
+	i := Interval{vs[0], vs[0]}
+	for _, v := range vs {
+		if math.IsNaN(float64(v)) {
+			return Unbounded
+		}
+		i.Min, i.Max = min32(i.Min, v), max32(i.Max, v)
+	}
+	return i
+}
+
+// increasing applies a non-decreasing function to both ends of a.
+func increasing(a Interval, f func(float64) float64) Interval {
+	return hull(float32(f(float64(a.Min))), float32(f(float64(a.Max))))
+}
+
+// periodic is the range of f, which has period 2 pi, its peaks at top and
+// its troughs at bottom plus multiples of the period.
+func periodic(a Interval, f func(float64) float64, top, bottom float64) Interval {
+	lo, hi := float64(a.Min), float64(a.Max)
+	if !a.Finite() || hi-lo >= 2*math.Pi {
+		return Interval{-1, 1}
+	}
+	i := hull(float32(f(lo)), float32(f(hi)))
+	if reaches(lo, hi, top) {
+		i.Max = 1
+	}
+	if reaches(lo, hi, bottom) {
+		i.Min = -1
+	}
+	return i
+}
+
+// reaches reports whether p plus some multiple of 2 pi lies in [lo, hi].
+func reaches(lo, hi, p float64) bool {
+	k := math.Ceil((lo - p) / (2 * math.Pi))
+	return p+k*2*math.Pi <= hi
+}
+
+func absRange(a Interval) Interval {
+	if a.Contains(0) {
+		return Interval{0, max32(-a.Min, a.Max)}
+	}
+	return hull(float32(math.Abs(float64(a.Min))), float32(math.Abs(float64(a.Max))))
+}
+
+func addRange(a, b Interval) Interval {
+	return hull(a.Min+b.Min, a.Max+b.Max)
+}
+
+func subRange(a, b Interval) Interval {
+	return hull(a.Min-b.Max, a.Max-b.Min)
+}
+
+func mulRange(a, b Interval) Interval {
+	return hull(a.Min*b.Min, a.Min*b.Max, a.Max*b.Min, a.Max*b.Max)
+}
+
+func divRange(a, b Interval) Interval {
+	if b.Contains(0) {
+		return Unbounded
+	}
+	return hull(a.Min/b.Min, a.Min/b.Max, a.Max/b.Min, a.Max/b.Max)
+}
+
+func squareRange(a Interval) Interval {
+	a = absRange(a)
+	return Interval{a.Min * a.Min, a.Max * a.Max}
+}
+
+func minRange(a, b Interval) Interval {
+	return Interval{min32(a.Min, b.Min), min32(a.Max, b.Max)}
+}
+
+func maxRange(a, b Interval) Interval {
+	return Interval{max32(a.Min, b.Min), max32(a.Max, b.Max)}
+}
+
+// powRange works on |a| like safePow. Both arguments move the result one
+// way only, so the extremes are at the corners, and safePow is 0 at a = 0.
+func powRange(a, b Interval) Interval {
+	a = absRange(a)
+	i := hull(
+		float32(saturatedPow(float64(a.Min), float64(b.Min))), float32(saturatedPow(float64(a.Min), float64(b.Max))),
+		float32(saturatedPow(float64(a.Max), float64(b.Min))), float32(saturatedPow(float64(a.Max), float64(b.Max))))
+	if a.Min == 0 {
+		i.Min = min32(i.Min, 0)
+	}
+	return i
+}
+
+// modQuotientLimit bounds |a / b| for modRange. Below it safeMod lands
+// between 0 and b, above it the rounding of b floor(a / b) shows.
+const modQuotientLimit = 1 << 24
+
+// modRange is between 0 and b, like safeMod, while a / b is small enough.
+// Otherwise b floor(a / b) is only within about |b| of a, so the result is
+// within |a| + |b| of 0.
+func modRange(a, b Interval) Interval {
+	aMax, bAbs := absRange(a).Max, absRange(b)
+	if bAbs.Min > 0 && float64(aMax)/float64(bAbs.Min) < modQuotientLimit {
+		return hull(0, b.Min, b.Max)
+	}
+	m := aMax + bAbs.Max
+	return hull(-m, m)
+}
+
+func stepRange(edge, a Interval) Interval {
+	switch {
+	case a.Max < edge.Min:
+		return Interval{0, 0}
+	case a.Min >= edge.Max:
+		return Interval{1, 1}
+	}
+	return Interval{0, 1}
+}
+
+func mixRange(a, b, t Interval) Interval {
+	return addRange(mulRange(a, subRange(Interval{1, 1}, t)), mulRange(b, t))
+}
+
+// clampRange puts the bounds in order like clamp32 before clamping.
+func clampRange(v, lo, hi Interval) Interval {
+	return minRange(maxRange(v, minRange(lo, hi)), maxRange(lo, hi))
+}
+
+func logRange(a Interval) Interval {
+	a = absRange(a)
+	if a.Min == 0 {
+		// log approaches -Inf near 0 but safeLog is 0 at 0
+		return Interval{float32(math.Inf(-1)), max32(0, float32(math.Log(float64(a.Max))))}
+	}
+	return increasing(a, math.Log)
+}
+
+// tanRange is the whole of the saturated range once it reaches an
+// asymptote.
+func tanRange(a Interval) Interval {
+	if !a.Finite() {
+		return Unbounded
+	}
+	lo, hi := float64(a.Min), float64(a.Max)
+	asymptote := math.Pi/2 + math.Ceil((lo-math.Pi/2)/math.Pi)*math.Pi
+	if asymptote <= hi {
+		return Interval{Min: -tanLimit, Max: tanLimit}
+	}
+	return increasing(a, saturatedTan)
+}
+
+// snoiseBound bounds the values of noise.Snoise2. It leaves out the usual
+// factor of 70 and its gradients are sqrt(5/2) times the usual length, so it
+// stays within about 0.0226 either way.
+const snoiseBound = 0.023
+
+// fractalBound bounds the sum of the octaves of fbm and turbulence.
+func fractalBound(gain, octaves Interval) float32 {
+	g := float64(absRange(gain).Max)
+	n := octaveCount(octaves.Max)
+	sum, amplitude := 0.0, 1.0
+	for i := 0; i < n; i++ {
+		sum += amplitude
+		amplitude *= g
+	}
+	return float32(sum * snoiseBound)
+}
+
+func fbmRange(args []Interval) Interval {
+	b := fractalBound(args[3], args[5])
+	return hull(-b, b)
+}
+
+func turbulenceRange(args []Interval) Interval {
+	return hull(0, fractalBound(args[3], args[5]))
+}
+
+// constRange is for operators whose values stay within the same bounds
+// whatever their children are.
+func constRange(min, max float32) func([]Interval) Interval {
+	return func([]Interval) Interval { return Interval{min, max} }
+}
@@ -0,0 +1,102 @@
+package apt
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// partNaN reports whether any part of node is NaN at x, y, following the
+// coordinates into the bodies of transforms like Eval.
+func partNaN(node Node, x, y float32) bool {
+	if v := node.Eval(x, y); math.IsNaN(float64(v)) {
+		return true
+	}
+	children := node.GetChildren()
+	switch n := node.(type) {
+	case *OpAtan2:
+		return false
+	case *OpDdx:
+		return partNaN(n.derived(), x, y)
+	case *OpDdy:
+		return partNaN(n.derived(), x, y)
+	case *OpWarp:
+		dx, dy := children[0].Eval(x, y), children[1].Eval(x, y)
+		return partNaN(children[0], x, y) || partNaN(children[1], x, y) || partNaN(children[2], x+dx, y+dy)
+	case *OpRotate:
+		rx, ry := rotate(x, y, children[0].Eval(x, y))
+		return partNaN(children[0], x, y) || partNaN(children[1], rx, ry)
+	case *OpScale:
+		s := children[0].Eval(x, y)
+		return partNaN(children[0], x, y) || partNaN(children[1], x*s, y*s)
+	case *OpPolar:
+		r, theta := toPolar(x, y)
+		return partNaN(children[0], r, theta)
+	}
+	for _, child := range children {
+		if partNaN(child, x, y) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRange fails t if node takes a value outside Range at some point of a
+// grid over xRange and yRange where no part of it is NaN.
+func checkRange(t *testing.T, name string, node Node, xRange, yRange Interval) {
+	t.Helper()
+	i := Range(node, xRange, yRange)
+	const n = 24
+	for yi := 0; yi <= n; yi++ {
+		y := yRange.Min + (yRange.Max-yRange.Min)*float32(yi)/n
+		for xi := 0; xi <= n; xi++ {
+			x := xRange.Min + (xRange.Max-xRange.Min)*float32(xi)/n
+			if v := node.Eval(x, y); !i.Contains(v) && !partNaN(node, x, y) {
+				t.Fatalf("%s is %v at %v, %v, outside %v over %v by %v\n%s", name, v, x, y, i, xRange, yRange, node)
+			}
+		}
+	}
+}
+
+func TestRangeHoldsEval(t *testing.T) {
+	domains := [][2]Interval{
+		{{Min: -1, Max: 1}, {Min: -1, Max: 1}},
+		{{Min: 0.2, Max: 0.6}, {Min: -0.7, Max: -0.1}},
+		{{Min: -40, Max: 40}, {Min: 3, Max: 3}},
+	}
+
+	trees := benchmarkTrees()
+	r := rand.New(rand.NewSource(8))
+	for i := 0; i < 100; i++ {
+		trees["random "+strconv.Itoa(i)] = randomTree(r)
+	}
+	for _, src := range []string{
+		"( ddx ( * x ( sin y ) ) )",
+		"( ddy ( pow x y ) )",
+		"( tan ( * x 3 ) )",
+		"( log ( - x x ) )",
+	} {
+		node, err := Parse(strings.NewReader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		trees[src] = node
+	}
+	trees["t"] = NewOpT()
+
+	withTestImages(func() {
+		image, err := Parse(strings.NewReader(`( image "photo" x y )`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		trees["image"] = image
+
+		for name, tree := range trees {
+			for _, d := range domains {
+				checkRange(t, name, tree, d[0], d[1])
+			}
+		}
+	})
+}
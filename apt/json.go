@@ -0,0 +1,177 @@
+package apt
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// JSONVersion is the version of the schema Tree is written in. It goes up
+// when the schema changes in a way older readers would get wrong.
+const JSONVersion = 1
+
+// Tree wraps a node so the tree under it can be written as JSON and read
+// back, as an alternative to String and Parse:
+//
+//	{"version": 1, "tree": {"op": "+", "children": [{"op": "x"}, {"op": "const", "value": 0.5}]}}
+//
+// Every node has the name of its operator, constants their value and nodes
+// with literal parameters, like image, their params as they are written in
+// the text form. Like in the text form, children with defaults may be left
+// out.
+type Tree struct {
+	Node Node
+}
+
+type jsonTree struct {
+	Version int       `json:"version"`
+	Tree    *jsonNode `json:"tree"`
+}
+
+type jsonNode struct {
+	Op       string      `json:"op"`
+	Params   []string    `json:"params,omitempty"`
+	Value    *jsonFloat  `json:"value,omitempty"`
+	Children []*jsonNode `json:"children,omitempty"`
+}
+
+// constOp is the operator constants are written with, since they have no
+// name of their own in the text form.
+const constOp = "const"
+
+func (t Tree) MarshalJSON() ([]byte, error) {
+	if t.Node == nil {
+		return nil, fmt.Errorf("apt: no tree to write")
+	}
+	return json.Marshal(jsonTree{JSONVersion, toJSON(t.Node)})
+}
+
+func (t *Tree) UnmarshalJSON(data []byte) error {
+	var doc jsonTree
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	switch {
+	case doc.Version == 0:
+		return fmt.Errorf("apt: tree has no version")
+	case doc.Version > JSONVersion:
+		return fmt.Errorf("apt: tree is version %d, only up to %d can be read", doc.Version, JSONVersion)
+	case doc.Tree == nil:
+		return fmt.Errorf("apt: no tree")
+	}
+	node, err := fromJSON(doc.Tree, nil, "tree")
+	if err != nil {
+		return err
+	}
+	t.Node = node
+	return nil
+}
+
+func toJSON(node Node) *jsonNode {
+	if c, ok := node.(*OpConst); ok {
+		v := jsonFloat(c.value)
+		return &jsonNode{Op: constOp, Value: &v}
+	}
+	n := &jsonNode{Op: nodeName(node)}
+	if pn, ok := node.(ParamNode); ok {
+		n.Params = pn.Params()
+	}
+	for _, child := range node.GetChildren() {
+		n.Children = append(n.Children, toJSON(child))
+	}
+	return n
+}
+
+// fromJSON builds the tree n describes. path says where n is for errors,
+// like tree.children[1].
+func fromJSON(n *jsonNode, parent Node, path string) (Node, error) {
+	if n == nil {
+		return nil, fmt.Errorf("apt: %s is null", path)
+	}
+	if n.Op == constOp {
+		if n.Value == nil {
+			return nil, fmt.Errorf("apt: %s: const without a value", path)
+		}
+		if len(n.Params) != 0 || len(n.Children) != 0 {
+			return nil, fmt.Errorf("apt: %s: const only has a value", path)
+		}
+		c := NewOpConst()
+		c.SetParent(parent)
+		c.value = float32(*n.Value)
+		return c, nil
+	}
+
+	node, ok := newNodeNamed(n.Op)
+	if !ok {
+		return nil, fmt.Errorf("apt: %s: unknown operator %q", path, n.Op)
+	}
+	node.SetParent(parent)
+	if n.Value != nil {
+		return nil, fmt.Errorf("apt: %s: %s has no value", path, n.Op)
+	}
+	pn, ok := node.(ParamNode)
+	switch {
+	case ok && len(n.Params) != len(pn.Params()):
+		return nil, fmt.Errorf("apt: %s: %s takes %d parameters, got %d", path, n.Op, len(pn.Params()), len(n.Params))
+	case ok:
+		if err := pn.SetParams(n.Params); err != nil {
+			return nil, fmt.Errorf("apt: %s: %v", path, err)
+		}
+	case len(n.Params) != 0:
+		return nil, fmt.Errorf("apt: %s: %s takes no parameters", path, n.Op)
+	}
+
+	children := node.GetChildren()
+	if len(n.Children) > len(children) || (len(n.Children) < len(children) && !fillDefaults(node, len(n.Children))) {
+		return nil, fmt.Errorf("apt: %s: %s takes %d children, got %d", path, n.Op, len(children), len(n.Children))
+	}
+	for i, child := range n.Children {
+		c, err := fromJSON(child, node, path+".children["+strconv.Itoa(i)+"]")
+		if err != nil {
+			return nil, err
+		}
+		children[i] = c
+	}
+	return node, nil
+}
+
+// jsonFloat is a float32 that is written as a string when JSON has no
+// number for it, "NaN", "Inf" or "-Inf".
+type jsonFloat float32
+
+func (f jsonFloat) MarshalJSON() ([]byte, error) {
+	v := float64(f)
+	switch {
+	case math.IsNaN(v):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(v, 1):
+		return []byte(`"Inf"`), nil
+	case math.IsInf(v, -1):
+		return []byte(`"-Inf"`), nil
+	}
+	return []byte(strconv.FormatFloat(v, 'g', -1, 32)), nil
+}
+
+func (f *jsonFloat) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		switch s {
+		case "NaN":
+			*f = jsonFloat(math.NaN())
+		case "Inf":
+			*f = jsonFloat(math.Inf(1))
+		case "-Inf":
+			*f = jsonFloat(math.Inf(-1))
+		default:
+			return fmt.Errorf("apt: %q is not a number", s)
+		}
+		return nil
+	}
+	v, err := strconv.ParseFloat(string(data), 32)
+	if err != nil {
+		return fmt.Errorf("apt: %s is not a number", data)
+	}
+	*f = jsonFloat(v)
+	return nil
+}
@@ -0,0 +1,101 @@
+package apt
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	trees := []Node{}
+	r := rand.New(rand.NewSource(6))
+	for i := 0; i < 200; i++ {
+		trees = append(trees, randomTree(r))
+	}
+	// constants JSON has no number for
+	for _, v := range []float64{math.NaN(), math.Inf(1), math.Inf(-1), math.Copysign(0, -1)} {
+		trees = append(trees, build("+", constNode(float32(v)), NewOpX()))
+	}
+
+	withTestImages(func() {
+		for _, src := range glslPictures {
+			tree, err := Parse(strings.NewReader(src))
+			if err != nil {
+				t.Fatal(err)
+			}
+			trees = append(trees, tree)
+		}
+
+		for _, tree := range trees {
+			data, err := json.Marshal(Tree{Node: tree})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var read Tree
+			if err := json.Unmarshal(data, &read); err != nil {
+				t.Fatalf("%v\n%s", err, data)
+			}
+			if !equalTrees(read.Node, tree) {
+				t.Fatalf("reads back as\n%s\nnot\n%s", read.Node, tree)
+			}
+		}
+	})
+}
+
+func TestJSONDefaults(t *testing.T) {
+	var read Tree
+	doc := `{"version": 1, "tree": {"op": "fbm", "children": [{"op": "x"}, {"op": "y"}, {"op": "const", "value": 2}]}}`
+	if err := json.Unmarshal([]byte(doc), &read); err != nil {
+		t.Fatal(err)
+	}
+	want, err := Parse(strings.NewReader("( fbm x y 2 )"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalTrees(read.Node, want) {
+		t.Fatalf("got %s, want %s", read.Node, want)
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	for _, test := range []struct {
+		doc, err string
+	}{
+		{`{"tree": {"op": "x"}}`, "no version"},
+		{`{"version": 0, "tree": {"op": "x"}}`, "no version"},
+		{`{"version": 2, "tree": {"op": "x"}}`, "version 2"},
+		{`{"version": 1}`, "no tree"},
+		{`{"version": 1, "tree": {"op": "bogus"}}`, `tree: unknown operator "bogus"`},
+		{`{"version": 1, "tree": {"op": "+", "children": [{"op": "x"}, {"op": "nope"}]}}`, `tree.children[1]: unknown operator "nope"`},
+		{`{"version": 1, "tree": {"op": "+", "children": [{"op": "x"}]}}`, "+ takes 2 children, got 1"},
+		{`{"version": 1, "tree": {"op": "sin", "children": [{"op": "x"}, {"op": "y"}]}}`, "sin takes 1 children, got 2"},
+		{`{"version": 1, "tree": {"op": "sin", "children": [null]}}`, "tree.children[0] is null"},
+		{`{"version": 1, "tree": {"op": "const"}}`, "const without a value"},
+		{`{"version": 1, "tree": {"op": "const", "value": 1, "children": [{"op": "x"}]}}`, "const only has a value"},
+		{`{"version": 1, "tree": {"op": "const", "value": "one"}}`, `"one" is not a number`},
+		{`{"version": 1, "tree": {"op": "const", "value": 1e99}}`, "is not a number"},
+		{`{"version": 1, "tree": {"op": "x", "value": 1}}`, "x has no value"},
+		{`{"version": 1, "tree": {"op": "x", "params": ["1"]}}`, "x takes no parameters"},
+		{`{"version": 1, "tree": {"op": "worleyf1", "children": [{"op": "x"}, {"op": "y"}]}}`, "worleyf1 takes 1 parameters, got 0"},
+		{`{"version": 1, "tree": {"op": "worleyf1", "params": ["half"], "children": [{"op": "x"}, {"op": "y"}]}}`, "must be a whole number"},
+		{`{"version": 1, "tree": `, "unexpected end of JSON input"},
+	} {
+		var read Tree
+		err := json.Unmarshal([]byte(test.doc), &read)
+		if err == nil {
+			t.Errorf("%s read as %s", test.doc, read.Node)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got %v, want it to say %q", test.doc, err, test.err)
+		}
+	}
+}
+
+func TestJSONNoTree(t *testing.T) {
+	if _, err := json.Marshal(Tree{}); err == nil {
+		t.Fatal("wrote an empty tree")
+	}
+}
@@ -1,6 +1,10 @@
 package apt
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"strconv"
 	"strings"
 	"unicode/utf8"
@@ -13,6 +17,9 @@ const (
 	closeParam
 	operator
 	constant
+	str
+	// unclosedStr is a string that runs on to the end of the input
+	unclosedStr
 )
 
 const eof rune = -1
@@ -20,12 +27,13 @@ const eof rune = -1
 type token struct {
 	typ   tokenType
 	value string
+	pos   int
 }
 
 type lexer struct {
 	input             string
 	start, pos, width int
-	tokens            chan token
+	tokens            []token
 }
 
 type stateFunc func(*lexer) stateFunc
@@ -49,7 +57,7 @@ func (l *lexer) ignore() {
 }
 
 func (l *lexer) emit(t tokenType) {
-	l.tokens <- token{t, l.input[l.start:l.pos]}
+	l.tokens = append(l.tokens, token{t, l.input[l.start:l.pos], l.start})
 	l.start = l.pos
 }
 
@@ -97,6 +105,23 @@ func lexOp(l *lexer) stateFunc {
 	return determineToken
 }
 
+// lexString lexes a quoted string, marking an unterminated one for the parser
+// to complain about.
+func lexString(l *lexer) stateFunc {
+	for {
+		switch l.next() {
+		case '\\':
+			l.next()
+		case '"':
+			l.emit(str)
+			return determineToken
+		case eof:
+			l.emit(unclosedStr)
+			return nil
+		}
+	}
+}
+
 func determineToken(l *lexer) stateFunc {
 	for {
 		switch r := l.next(); {
@@ -108,6 +133,8 @@ func determineToken(l *lexer) stateFunc {
 			l.emit(closeParam)
 		case isStartOfNumber(r):
 			return lexNumber
+		case r == '"':
+			return lexString
 		case r == eof:
 			return nil
 		default:
@@ -120,87 +147,225 @@ func (l *lexer) run() {
 	for state := determineToken; state != nil; {
 		state = state(l)
 	}
-	close(l.tokens)
-}
-
-func stringToNode(s string) Node {
-	switch s {
-	case "+":
-		return NewOpPlus()
-	case "-":
-		return NewOpMinus()
-	case "*":
-		return NewOpMultiplies()
-	case "/":
-		return NewOpDivide()
-	case "atan2":
-		return NewOpAtan2()
-	case "atan":
-		return NewOpAtan()
-	case "sin":
-		return NewOpSin()
-	case "cos":
-		return NewOpCos()
-	case "snoise2":
-		return NewOpNoise()
-	case "turbulence":
-		return NewTurbulence()
-	case "ceil":
-		return NewOpCeil()
-	case "fbm":
-		return NewOpFbm()
-	case "floor":
-		return NewOpFloor()
-	case "negate":
-		return NewOpNegate()
-	case "square":
-		return NewOpSquare()
-	case "abs":
-		return NewOpAbs()
-	case "x":
-		return NewOpX()
-	case "y":
-		return NewOpY()
-	case "picture":
-		return NewOpPict()
-	default:
-		panic("didnt understand what you mean" + s)
-	}
-}
-
-func parse(tokens chan token, parent Node) Node {
-	for {
-		token, ok := <- tokens
-		if !ok {
-			panic("no more tokens")
+}
+
+var (
+	ErrUnexpectedEOF   = errors.New("unexpected end of input")
+	ErrUnbalanced      = errors.New("unbalanced parentheses")
+	ErrUnknownOperator = errors.New("unknown operator")
+	ErrArity           = errors.New("wrong number of arguments")
+	ErrBadNumber       = errors.New("bad number")
+	ErrUnexpectedToken = errors.New("unexpected token")
+	ErrBadParam        = errors.New("bad parameter")
+)
+
+// ParseError is returned by Parse. It wraps one of the Err values above and
+// says where in the input the problem was found.
+type ParseError struct {
+	Line, Column int
+	Err          error
+	Msg          string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%d:%d: %v: %s", e.Line, e.Column, e.Err, e.Msg)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+type parser struct {
+	input  string
+	tokens []token
+	pos    int
+}
+
+func (p *parser) errorAt(offset int, err error, format string, args ...interface{}) *ParseError {
+	line, column := 1, 1
+	for _, r := range p.input[:offset] {
+		if r == '\n' {
+			line++
+			column = 1
+		} else {
+			column++
 		}
+	}
+	return &ParseError{line, column, err, fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) unclosed(t token) *ParseError {
+	return p.errorAt(t.pos, ErrUnexpectedEOF, "string %s is never closed", t.value)
+}
+
+func (p *parser) next() (token, bool) {
+	if p.pos >= len(p.tokens) {
+		return token{}, false
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	return t, true
+}
+
+// parseExpr parses a constant, a bare leaf like x, or a parenthesized
+// operator with exactly as many arguments as it takes.
+func (p *parser) parseExpr(parent Node) (Node, error) {
+	t, ok := p.next()
+	if !ok {
+		return nil, p.errorAt(len(p.input), ErrUnexpectedEOF, "expected an expression")
+	}
+
+	switch t.typ {
+	case constant:
+		v, err := strconv.ParseFloat(t.value, 32)
+		if err != nil {
+			return nil, p.errorAt(t.pos, ErrBadNumber, "%q", t.value)
+		}
+		n := NewOpConst()
+		n.SetParent(parent)
+		n.value = float32(v)
+		return n, nil
+	case operator:
+		n, err := p.operator(t, parent)
+		if err != nil {
+			return nil, err
+		}
+		if len(n.GetChildren()) != 0 {
+			return nil, p.errorAt(t.pos, ErrArity, "%s takes %d arguments and must be written in parentheses", t.value, len(n.GetChildren()))
+		}
+		return n, nil
+	case closeParam:
+		return nil, p.errorAt(t.pos, ErrUnbalanced, "unexpected )")
+	case str:
+		return nil, p.errorAt(t.pos, ErrUnexpectedToken, "expected an expression, got %s", t.value)
+	case unclosedStr:
+		return nil, p.unclosed(t)
+	}
 
-		switch token.typ {
-		case openParam, closeParam:
-			continue
-		case operator:
-			n := stringToNode(token.value)
-			n.SetParent(parent)
-			for i := range n.GetChildren() {
-				n.GetChildren()[i] = parse(tokens, n)
+	open := t
+	t, ok = p.next()
+	if !ok {
+		return nil, p.errorAt(open.pos, ErrUnbalanced, "( is never closed")
+	}
+	if t.typ != operator {
+		return nil, p.errorAt(t.pos, ErrUnknownOperator, "expected an operator after (, got %q", t.value)
+	}
+	n, err := p.operator(t, parent)
+	if err != nil {
+		return nil, err
+	}
+	if pn, ok := n.(ParamNode); ok {
+		if err := p.params(t, pn); err != nil {
+			return nil, err
+		}
+	}
+
+	children := n.GetChildren()
+	for i := 0; ; i++ {
+		if p.pos >= len(p.tokens) {
+			return nil, p.errorAt(open.pos, ErrUnbalanced, "( is never closed")
+		}
+		if p.tokens[p.pos].typ == closeParam {
+			if i != len(children) && !fillDefaults(n, i) {
+				return nil, p.errorAt(t.pos, ErrArity, "%s takes %d arguments, got %d", t.value, len(children), i)
 			}
-			return n
-		case constant:
-			n := NewOpConst()
-			n.SetParent(parent)
-			v, err := strconv.ParseFloat(token.value, 32)
-			if err != nil {
-				panic(err)
+			p.pos++
+			return n, nil
+		}
+		if i >= len(children) {
+			// count the rest so the message can say how many there were
+			extra := i
+			for p.pos < len(p.tokens) && p.tokens[p.pos].typ != closeParam {
+				if _, err := p.parseExpr(n); err != nil {
+					return nil, err
+				}
+				extra++
 			}
-			n.value = float32(v)
-			return n
+			return nil, p.errorAt(t.pos, ErrArity, "%s takes %d arguments, got %d", t.value, len(children), extra)
+		}
+		child, err := p.parseExpr(n)
+		if err != nil {
+			return nil, err
 		}
+		children[i] = child
+	}
+}
+
+// params reads the literal parameters of the operator op, as many as it has.
+func (p *parser) params(op token, n ParamNode) error {
+	params := make([]string, len(n.Params()))
+	for i := range params {
+		t, ok := p.next()
+		if !ok {
+			return p.errorAt(len(p.input), ErrUnexpectedEOF, "%s takes %d parameters", op.value, len(params))
+		}
+		if t.typ == unclosedStr {
+			return p.unclosed(t)
+		}
+		if t.typ != str && t.typ != constant {
+			return p.errorAt(t.pos, ErrBadParam, "%s takes %d parameters, got %q", op.value, len(params), t.value)
+		}
+		params[i] = t.value
+	}
+	if err := n.SetParams(params); err != nil {
+		return p.errorAt(op.pos, ErrBadParam, "%v", err)
 	}
 	return nil
 }
 
+// fillDefaults fills in the children of n from given on with constants, if
+// its spec has defaults for all of them.
+func fillDefaults(n Node, given int) bool {
+	s := specOf(n)
+	children := n.GetChildren()
+	missing := len(children) - given
+	if s == nil || missing > len(s.Defaults) {
+		return false
+	}
+	for i, v := range s.Defaults[len(s.Defaults)-missing:] {
+		c := &OpConst{BaseNode{n, make([]Node, 0)}, v}
+		children[given+i] = c
+	}
+	return true
+}
+
+func (p *parser) operator(t token, parent Node) (Node, error) {
+	n, ok := newNodeNamed(t.value)
+	if !ok {
+		return nil, p.errorAt(t.pos, ErrUnknownOperator, "%q, known operators are %s", t.value, strings.Join(Operators(), " "))
+	}
+	n.SetParent(parent)
+	return n, nil
+}
+
+// Parse reads a tree written out by String. Unlike BeginLexing it never
+// panics, problems with the input come back as a *ParseError.
+func Parse(r io.Reader) (Node, error) {
+	input, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	l := &lexer{input: string(input)}
+	l.run()
+
+	p := &parser{input: l.input, tokens: l.tokens}
+	node, err := p.parseExpr(nil)
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := p.next(); ok {
+		if t.typ == closeParam {
+			return nil, p.errorAt(t.pos, ErrUnbalanced, "unexpected )")
+		}
+		return nil, p.errorAt(t.pos, ErrUnexpectedToken, "%q after the end of the tree", t.value)
+	}
+	return node, nil
+}
+
 func BeginLexing(s string) Node {
-	l := &lexer{input: s, tokens: make(chan token, 100)}
-	go l.run()
-	return parse(l.tokens, nil)
-}
\ No newline at end of file
+	node, err := Parse(strings.NewReader(s))
+	if err != nil {
+		panic(err)
+	}
+	return node
+}
@@ -0,0 +1,36 @@
+//go:build go1.18
+
+package apt
+
+import (
+	"strings"
+	"testing"
+)
+
+// FuzzParse checks Parse never panics, and that whatever it accepts reads back
+// the same after Format.
+func FuzzParse(f *testing.F) {
+	for _, test := range badTrees {
+		f.Add(test.src)
+	}
+	for _, src := range glslPictures {
+		f.Add(src)
+	}
+	f.Add("( fbm x y 2 )")
+	f.Add("( ddx ( * x ( sin -0.5 ) ) )")
+
+	f.Fuzz(func(t *testing.T, src string) {
+		node, err := Parse(strings.NewReader(src))
+		if err != nil {
+			return
+		}
+		formatted := Format(node, DefaultFormatOptions)
+		again, err := Parse(strings.NewReader(formatted))
+		if err != nil {
+			t.Fatalf("%q parses but its formatted form doesn't: %v\n%s", src, err, formatted)
+		}
+		if !equalTrees(node, again) {
+			t.Fatalf("%q reads back differently after Format\n%s\n%s", src, node, again)
+		}
+	})
+}
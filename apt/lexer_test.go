@@ -0,0 +1,64 @@
+package apt
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// badTrees are malformed inputs, with the error Parse wraps for each and
+// where it says the problem is.
+var badTrees = []struct {
+	src          string
+	err          error
+	line, column int
+}{
+	{"", ErrUnexpectedEOF, 1, 1},
+	{"  \n ", ErrUnexpectedEOF, 2, 2},
+	{"(", ErrUnbalanced, 1, 1},
+	{")", ErrUnbalanced, 1, 1},
+	{"( + x y", ErrUnbalanced, 1, 1},
+	{"\n\n  ( sin ( cos x )\n", ErrUnbalanced, 3, 3},
+	{"( + x y ) )", ErrUnbalanced, 1, 11},
+	{"( bogus x )", ErrUnknownOperator, 1, 3},
+	{"( )", ErrUnknownOperator, 1, 3},
+	{"( 3 x )", ErrUnknownOperator, 1, 3},
+	{"( + x )", ErrArity, 1, 3},
+	{"( + x ( sin ) )", ErrArity, 1, 9},
+	{"( picture x y )", ErrArity, 1, 3},
+	{"( sin + )", ErrArity, 1, 7},
+	{"( sin 1.2.3 )", ErrBadNumber, 1, 7},
+	{"( sin 1..2 )", ErrBadNumber, 1, 7},
+	{"( sin 1e99 )", ErrUnknownOperator, 1, 8},
+	{"( + 99999999999999999999999999999999999999999 x )", ErrBadNumber, 1, 5},
+	{`"abc`, ErrUnexpectedEOF, 1, 1},
+	{`( image "photo`, ErrUnexpectedEOF, 1, 9},
+	{"( image \"photo\n x y )", ErrUnexpectedEOF, 1, 9},
+	{`( image "no such image" x y )`, ErrBadParam, 1, 3},
+	{"( image photo x y )", ErrBadParam, 1, 9},
+	{"( worleyf1 x x y )", ErrBadParam, 1, 12},
+	{"( worleyf1 1.5 x y )", ErrBadParam, 1, 3},
+	{`"abc"`, ErrUnexpectedToken, 1, 1},
+	{"x y", ErrUnexpectedToken, 1, 3},
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, test := range badTrees {
+		node, err := Parse(strings.NewReader(test.src))
+		if err == nil {
+			t.Errorf("%q parsed as %s", test.src, node)
+			continue
+		}
+		var pe *ParseError
+		if !errors.As(err, &pe) {
+			t.Errorf("%q: %v is not a *ParseError", test.src, err)
+			continue
+		}
+		if !errors.Is(err, test.err) {
+			t.Errorf("%q: got %v, want %v", test.src, err, test.err)
+		}
+		if pe.Line != test.line || pe.Column != test.column {
+			t.Errorf("%q: error at %d:%d, want %d:%d: %v", test.src, pe.Line, pe.Column, test.line, test.column, err)
+		}
+	}
+}
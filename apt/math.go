@@ -0,0 +1,417 @@
+package apt
+
+import "math"
+
+// The functions below are shared by the nodes and their specs, so the tree
+// walker and compiled programs agree exactly. They are defined for every
+// input instead of producing NaN outside the usual domain. Products that are
+// added to something are converted explicitly, which rounds them, so no
+// platform fuses them into a multiply-add and the Go that GenerateGo writes,
+// with copies of these, agrees too.
+
+// safePow raises |a| to the power b, with 0 to any power being 0. Like exp32
+// it saturates at the largest float32 where it would overflow.
+func safePow(a, b float32) float32 {
+	if a == 0 {
+		return 0
+	}
+	return float32(saturatedPow(math.Abs(float64(a)), float64(b)))
+}
+
+func saturatedPow(a, b float64) float64 {
+	return math.Min(math.Pow(a, b), math.MaxFloat32)
+}
+
+// safeMod is a modulo b with the sign of b, like GLSL mod, and 0 when b is 0.
+func safeMod(a, b float32) float32 {
+	if b == 0 {
+		return 0
+	}
+	return float32(float64(a) - float64(float64(b)*math.Floor(float64(a)/float64(b))))
+}
+
+func min32(a, b float32) float32 {
+	if b < a {
+		return b
+	}
+	return a
+}
+
+func max32(a, b float32) float32 {
+	if b > a {
+		return b
+	}
+	return a
+}
+
+// step is 0 below edge and 1 from edge on.
+func step(edge, a float32) float32 {
+	if a < edge {
+		return 0
+	}
+	return 1
+}
+
+// mix blends linearly from a at t = 0 to b at t = 1.
+func mix(a, b, t float32) float32 {
+	return float32(a*(1-t)) + float32(b*t)
+}
+
+// clamp32 keeps v between lo and hi, whichever way round they are.
+func clamp32(v, lo, hi float32) float32 {
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+	return min32(max32(v, lo), hi)
+}
+
+// smoothstep eases from 0 at e0 to 1 at e1, and is a step when they meet.
+func smoothstep(e0, e1, a float32) float32 {
+	if e0 == e1 {
+		return step(e0, a)
+	}
+	t := clamp32((a-e0)/(e1-e0), 0, 1)
+	return float32(t * t * (3 - float32(2*t)))
+}
+
+// safeSqrt is the square root of |a|.
+func safeSqrt(a float32) float32 {
+	return float32(math.Sqrt(math.Abs(float64(a))))
+}
+
+// safeLog is the natural log of |a|, and 0 at 0.
+func safeLog(a float32) float32 {
+	if a == 0 {
+		return 0
+	}
+	return float32(math.Log(math.Abs(float64(a))))
+}
+
+// exp32 is e to the power a, saturating at the largest float32 where it
+// would overflow, from a of about 88.7 on.
+func exp32(a float32) float32 {
+	return float32(math.Min(math.Exp(float64(a)), math.MaxFloat32))
+}
+
+// tanLimit bounds tan, which heads off to infinity near its poles.
+const tanLimit = 1e4
+
+// tan32 is the tangent of a, saturating at tanLimit either way.
+func tan32(a float32) float32 {
+	return float32(saturatedTan(float64(a)))
+}
+
+func saturatedTan(a float64) float64 {
+	return math.Max(-tanLimit, math.Min(tanLimit, math.Tan(a)))
+}
+
+type OpPow struct {
+	BaseNode
+}
+
+func NewOpPow() *OpPow {
+	return &OpPow{BaseNode{nil, make([]Node, 2)}}
+}
+
+func (op *OpPow) Eval(x, y float32) float32 {
+	return safePow(op.Children[0].Eval(x, y), op.Children[1].Eval(x, y))
+}
+
+func (op *OpPow) EvalRow(xs []float32, y float32, out []float32) {
+	s := getRows(1, len(xs))
+	defer s.release()
+	b := s.rows[0]
+	op.Children[0].EvalRow(xs, y, out)
+	op.Children[1].EvalRow(xs, y, b)
+	for i := range out {
+		out[i] = safePow(out[i], b[i])
+	}
+}
+
+func (op *OpPow) String() string {
+	return "( pow " + op.Children[0].String() + " " + op.Children[1].String() + " )"
+}
+
+type OpMod struct {
+	BaseNode
+}
+
+func NewOpMod() *OpMod {
+	return &OpMod{BaseNode{nil, make([]Node, 2)}}
+}
+
+func (op *OpMod) Eval(x, y float32) float32 {
+	return safeMod(op.Children[0].Eval(x, y), op.Children[1].Eval(x, y))
+}
+
+func (op *OpMod) EvalRow(xs []float32, y float32, out []float32) {
+	s := getRows(1, len(xs))
+	defer s.release()
+	b := s.rows[0]
+	op.Children[0].EvalRow(xs, y, out)
+	op.Children[1].EvalRow(xs, y, b)
+	for i := range out {
+		out[i] = safeMod(out[i], b[i])
+	}
+}
+
+func (op *OpMod) String() string {
+	return "( mod " + op.Children[0].String() + " " + op.Children[1].String() + " )"
+}
+
+type OpMin struct {
+	BaseNode
+}
+
+func NewOpMin() *OpMin {
+	return &OpMin{BaseNode{nil, make([]Node, 2)}}
+}
+
+func (op *OpMin) Eval(x, y float32) float32 {
+	return min32(op.Children[0].Eval(x, y), op.Children[1].Eval(x, y))
+}
+
+func (op *OpMin) EvalRow(xs []float32, y float32, out []float32) {
+	s := getRows(1, len(xs))
+	defer s.release()
+	b := s.rows[0]
+	op.Children[0].EvalRow(xs, y, out)
+	op.Children[1].EvalRow(xs, y, b)
+	for i := range out {
+		out[i] = min32(out[i], b[i])
+	}
+}
+
+func (op *OpMin) String() string {
+	return "( min " + op.Children[0].String() + " " + op.Children[1].String() + " )"
+}
+
+type OpMax struct {
+	BaseNode
+}
+
+func NewOpMax() *OpMax {
+	return &OpMax{BaseNode{nil, make([]Node, 2)}}
+}
+
+func (op *OpMax) Eval(x, y float32) float32 {
+	return max32(op.Children[0].Eval(x, y), op.Children[1].Eval(x, y))
+}
+
+func (op *OpMax) EvalRow(xs []float32, y float32, out []float32) {
+	s := getRows(1, len(xs))
+	defer s.release()
+	b := s.rows[0]
+	op.Children[0].EvalRow(xs, y, out)
+	op.Children[1].EvalRow(xs, y, b)
+	for i := range out {
+		out[i] = max32(out[i], b[i])
+	}
+}
+
+func (op *OpMax) String() string {
+	return "( max " + op.Children[0].String() + " " + op.Children[1].String() + " )"
+}
+
+type OpStep struct {
+	BaseNode
+}
+
+func NewOpStep() *OpStep {
+	return &OpStep{BaseNode{nil, make([]Node, 2)}}
+}
+
+func (op *OpStep) Eval(x, y float32) float32 {
+	return step(op.Children[0].Eval(x, y), op.Children[1].Eval(x, y))
+}
+
+func (op *OpStep) EvalRow(xs []float32, y float32, out []float32) {
+	s := getRows(1, len(xs))
+	defer s.release()
+	b := s.rows[0]
+	op.Children[0].EvalRow(xs, y, out)
+	op.Children[1].EvalRow(xs, y, b)
+	for i := range out {
+		out[i] = step(out[i], b[i])
+	}
+}
+
+func (op *OpStep) String() string {
+	return "( step " + op.Children[0].String() + " " + op.Children[1].String() + " )"
+}
+
+type OpMix struct {
+	BaseNode
+}
+
+func NewOpMix() *OpMix {
+	return &OpMix{BaseNode{nil, make([]Node, 3)}}
+}
+
+func (op *OpMix) Eval(x, y float32) float32 {
+	return mix(op.Children[0].Eval(x, y), op.Children[1].Eval(x, y), op.Children[2].Eval(x, y))
+}
+
+func (op *OpMix) EvalRow(xs []float32, y float32, out []float32) {
+	s := getRows(2, len(xs))
+	defer s.release()
+	b, c := s.rows[0], s.rows[1]
+	op.Children[0].EvalRow(xs, y, out)
+	op.Children[1].EvalRow(xs, y, b)
+	op.Children[2].EvalRow(xs, y, c)
+	for i := range out {
+		out[i] = mix(out[i], b[i], c[i])
+	}
+}
+
+func (op *OpMix) String() string {
+	return "( mix " + op.Children[0].String() + " " + op.Children[1].String() + " " + op.Children[2].String() + " )"
+}
+
+type OpClamp struct {
+	BaseNode
+}
+
+func NewOpClamp() *OpClamp {
+	return &OpClamp{BaseNode{nil, make([]Node, 3)}}
+}
+
+func (op *OpClamp) Eval(x, y float32) float32 {
+	return clamp32(op.Children[0].Eval(x, y), op.Children[1].Eval(x, y), op.Children[2].Eval(x, y))
+}
+
+func (op *OpClamp) EvalRow(xs []float32, y float32, out []float32) {
+	s := getRows(2, len(xs))
+	defer s.release()
+	b, c := s.rows[0], s.rows[1]
+	op.Children[0].EvalRow(xs, y, out)
+	op.Children[1].EvalRow(xs, y, b)
+	op.Children[2].EvalRow(xs, y, c)
+	for i := range out {
+		out[i] = clamp32(out[i], b[i], c[i])
+	}
+}
+
+func (op *OpClamp) String() string {
+	return "( clamp " + op.Children[0].String() + " " + op.Children[1].String() + " " + op.Children[2].String() + " )"
+}
+
+type OpSmoothstep struct {
+	BaseNode
+}
+
+func NewOpSmoothstep() *OpSmoothstep {
+	return &OpSmoothstep{BaseNode{nil, make([]Node, 3)}}
+}
+
+func (op *OpSmoothstep) Eval(x, y float32) float32 {
+	return smoothstep(op.Children[0].Eval(x, y), op.Children[1].Eval(x, y), op.Children[2].Eval(x, y))
+}
+
+func (op *OpSmoothstep) EvalRow(xs []float32, y float32, out []float32) {
+	s := getRows(2, len(xs))
+	defer s.release()
+	b, c := s.rows[0], s.rows[1]
+	op.Children[0].EvalRow(xs, y, out)
+	op.Children[1].EvalRow(xs, y, b)
+	op.Children[2].EvalRow(xs, y, c)
+	for i := range out {
+		out[i] = smoothstep(out[i], b[i], c[i])
+	}
+}
+
+func (op *OpSmoothstep) String() string {
+	return "( smoothstep " + op.Children[0].String() + " " + op.Children[1].String() + " " + op.Children[2].String() + " )"
+}
+
+type OpSqrt struct {
+	BaseNode
+}
+
+func NewOpSqrt() *OpSqrt {
+	return &OpSqrt{BaseNode{nil, make([]Node, 1)}}
+}
+
+func (op *OpSqrt) Eval(x, y float32) float32 {
+	return safeSqrt(op.Children[0].Eval(x, y))
+}
+
+func (op *OpSqrt) EvalRow(xs []float32, y float32, out []float32) {
+	op.Children[0].EvalRow(xs, y, out)
+	for i := range out {
+		out[i] = safeSqrt(out[i])
+	}
+}
+
+func (op *OpSqrt) String() string {
+	return "( sqrt " + op.Children[0].String() + " )"
+}
+
+type OpLog struct {
+	BaseNode
+}
+
+func NewOpLog() *OpLog {
+	return &OpLog{BaseNode{nil, make([]Node, 1)}}
+}
+
+func (op *OpLog) Eval(x, y float32) float32 {
+	return safeLog(op.Children[0].Eval(x, y))
+}
+
+func (op *OpLog) EvalRow(xs []float32, y float32, out []float32) {
+	op.Children[0].EvalRow(xs, y, out)
+	for i := range out {
+		out[i] = safeLog(out[i])
+	}
+}
+
+func (op *OpLog) String() string {
+	return "( log " + op.Children[0].String() + " )"
+}
+
+type OpExp struct {
+	BaseNode
+}
+
+func NewOpExp() *OpExp {
+	return &OpExp{BaseNode{nil, make([]Node, 1)}}
+}
+
+func (op *OpExp) Eval(x, y float32) float32 {
+	return exp32(op.Children[0].Eval(x, y))
+}
+
+func (op *OpExp) EvalRow(xs []float32, y float32, out []float32) {
+	op.Children[0].EvalRow(xs, y, out)
+	for i := range out {
+		out[i] = exp32(out[i])
+	}
+}
+
+func (op *OpExp) String() string {
+	return "( exp " + op.Children[0].String() + " )"
+}
+
+type OpTan struct {
+	BaseNode
+}
+
+func NewOpTan() *OpTan {
+	return &OpTan{BaseNode{nil, make([]Node, 1)}}
+}
+
+func (op *OpTan) Eval(x, y float32) float32 {
+	return tan32(op.Children[0].Eval(x, y))
+}
+
+func (op *OpTan) EvalRow(xs []float32, y float32, out []float32) {
+	op.Children[0].EvalRow(xs, y, out)
+	for i := range out {
+		out[i] = tan32(out[i])
+	}
+}
+
+func (op *OpTan) String() string {
+	return "( tan " + op.Children[0].String() + " )"
+}
@@ -0,0 +1,94 @@
+package apt
+
+import (
+	"fmt"
+	"math"
+)
+
+// NumericPolicy says what a Program does with values a float32 can't hold
+// as a number.
+type NumericPolicy int
+
+const (
+	// Strict gives NaN and Inf just like Eval does.
+	Strict NumericPolicy = iota
+	// Safe divides by zero to 0, turns NaN into 0 and saturates values
+	// that overflow at the largest float32, after every instruction, so
+	// only finite values come out.
+	Safe
+)
+
+func (p NumericPolicy) String() string {
+	switch p {
+	case Strict:
+		return "strict"
+	case Safe:
+		return "safe"
+	}
+	return fmt.Sprintf("NumericPolicy(%d)", int(p))
+}
+
+// ParseNumericPolicy reads a policy written by String.
+func ParseNumericPolicy(s string) (NumericPolicy, error) {
+	switch s {
+	case "strict":
+		return Strict, nil
+	case "safe":
+		return Safe, nil
+	}
+	return Strict, fmt.Errorf("unknown numeric policy %q, want strict or safe", s)
+}
+
+// finite is v under the Safe policy.
+func finite(v float32) float32 {
+	switch {
+	case v != v:
+		return 0
+	case v > math.MaxFloat32:
+		return math.MaxFloat32
+	case v < -math.MaxFloat32:
+		return -math.MaxFloat32
+	}
+	return v
+}
+
+func finiteRow(row []float32) {
+	for j, v := range row {
+		row[j] = finite(v)
+	}
+}
+
+// NonFiniteShare samples channels on a size by size grid over -1 to 1, like
+// the pixels of a picture that size, at time t, and returns the share of the
+// points where any of them is NaN or Inf under the Strict policy. Pictures
+// that are mostly non-finite come out as flat color, so this finds the ones
+// worth dropping. It fails if a channel can't be compiled.
+func NonFiniteShare(channels []Node, size int, t float32) (float64, error) {
+	xs := make([]float32, size)
+	for i := range xs {
+		xs[i] = float32(i)/float32(size)*2 - 1
+	}
+	bad := make([]bool, size*size)
+	row := make([]float32, size)
+	for _, channel := range channels {
+		p, err := Compile(channel)
+		if err != nil {
+			return 0, err
+		}
+		for yi := 0; yi < size; yi++ {
+			p.EvalRowAt(xs, float32(yi)/float32(size)*2-1, t, row)
+			for xi, v := range row {
+				if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+					bad[yi*size+xi] = true
+				}
+			}
+		}
+	}
+	count := 0
+	for _, b := range bad {
+		if b {
+			count++
+		}
+	}
+	return float64(count) / float64(len(bad)), nil
+}
@@ -0,0 +1,314 @@
+package apt
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+
+	"github.com/ahmadfarhanstwn/noise"
+)
+
+// OpSpec describes an operator. Registering it makes the operator available
+// to the parser, to random generation and mutation, and to CopyTree.
+type OpSpec struct {
+	Name  string
+	Arity int
+	// New makes a node for the operator. It can be left nil when the
+	// operator just combines the values of its children, Register then
+	// uses an OpFunc that calls Eval.
+	New func() Node
+	// Eval computes the value of the operator from the values of its
+	// children. It must be left nil for operators that look at anything
+	// else, like x, y or t, so Simplify knows not to fold them.
+	Eval func(args []float32) float32
+	// Weight is how likely GetRandomNodeOpt is to pick the operator, or
+	// GetRandomLeafNode if it has no children, compared to the others.
+	// Operators with no weight are never picked at random.
+	Weight int
+	// Enabled, if set, is asked before the operator is picked at random.
+	Enabled func() bool
+	// Range bounds the values of the operator given bounds on the values of
+	// its children, for the Range function. Operators without one are
+	// taken to be unbounded.
+	Range func(args []Interval) Interval
+	// Defaults are the values of the last children, which may be left out
+	// when the operator is written. They let files written before the
+	// operator took those children still load.
+	Defaults []float32
+	// Cost is about how long the operator takes to evaluate at a point,
+	// leaving out its children, counting an addition as 1. For fbm and
+	// turbulence it is the cost of an octave. Operators without one count
+	// as 1.
+	Cost float64
+}
+
+var (
+	specs       []*OpSpec
+	specsByName = map[string]*OpSpec{}
+	specsByType = map[reflect.Type]*OpSpec{}
+)
+
+// Register adds an operator. It is meant to be called from init functions
+// and panics if the name is taken or the spec can't make nodes.
+func Register(spec OpSpec) {
+	if _, ok := specsByName[spec.Name]; ok {
+		panic("apt: operator registered twice: " + spec.Name)
+	}
+	if spec.New == nil && spec.Eval == nil {
+		panic("apt: operator needs New or Eval: " + spec.Name)
+	}
+
+	s := &spec
+	specs = append(specs, s)
+	specsByName[s.Name] = s
+	if s.New != nil {
+		t := reflect.TypeOf(s.New())
+		if _, ok := specsByType[t]; !ok {
+			specsByType[t] = s
+		}
+	}
+}
+
+// Lookup returns the spec of the operator called name.
+func Lookup(name string) (OpSpec, bool) {
+	s, ok := specsByName[name]
+	if !ok {
+		return OpSpec{}, false
+	}
+	return *s, true
+}
+
+// Operators returns the names of all registered operators, sorted.
+func Operators() []string {
+	names := make([]string, 0, len(specs))
+	for _, s := range specs {
+		names = append(names, s.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SpecOf returns the spec of the operator node was made for. Constants have
+// no spec.
+func SpecOf(node Node) (OpSpec, bool) {
+	s := specOf(node)
+	if s == nil {
+		return OpSpec{}, false
+	}
+	return *s, true
+}
+
+func specOf(node Node) *OpSpec {
+	if f, ok := node.(*OpFunc); ok {
+		return f.spec
+	}
+	return specsByType[reflect.TypeOf(node)]
+}
+
+func newNode(s *OpSpec) Node {
+	if s.New != nil {
+		return s.New()
+	}
+	return &OpFunc{BaseNode{nil, make([]Node, s.Arity)}, s}
+}
+
+// newNodeNamed makes a node for the operator called name.
+func newNodeNamed(name string) (Node, bool) {
+	s, ok := specsByName[name]
+	if !ok {
+		return nil, false
+	}
+	return newNode(s), true
+}
+
+// randomNode picks one of the enabled operators, leaves if leaf is set, by
+// weight. extra is the weight of something the caller picks itself, and
+// randomNode returns nil when that is what comes up. All the randomness,
+// including that of the node it makes, comes from r.
+func randomNode(r *rand.Rand, leaf bool, extra int) Node {
+	total := extra
+	for _, s := range specs {
+		if s.pickable(leaf) {
+			total += s.Weight
+		}
+	}
+	n := r.Intn(total)
+	for _, s := range specs {
+		if !s.pickable(leaf) {
+			continue
+		}
+		if n < s.Weight {
+			node := newNode(s)
+			if rn, ok := node.(randomizer); ok {
+				rn.randomize(r)
+			}
+			return node
+		}
+		n -= s.Weight
+	}
+	return nil
+}
+
+func (s *OpSpec) pickable(leaf bool) bool {
+	return s.Weight > 0 && (s.Arity == 0) == leaf && (s.Enabled == nil || s.Enabled())
+}
+
+// OpFunc is the node used for operators registered without New.
+type OpFunc struct {
+	BaseNode
+	spec *OpSpec
+}
+
+func (op *OpFunc) Eval(x, y float32) float32 {
+	args := make([]float32, len(op.Children))
+	for i, child := range op.Children {
+		args[i] = child.Eval(x, y)
+	}
+	return op.spec.Eval(args)
+}
+
+func (op *OpFunc) EvalRow(xs []float32, y float32, out []float32) {
+	s := getRows(len(op.Children), len(xs))
+	defer s.release()
+	rows := evalChildRows(op, xs, y, s.rows)
+	args := s.args
+	for j := range out {
+		for i := range rows {
+			args[i] = rows[i][j]
+		}
+		out[j] = op.spec.Eval(args)
+	}
+}
+
+func (op *OpFunc) String() string {
+	if len(op.Children) == 0 {
+		return op.spec.Name
+	}
+	s := "( " + op.spec.Name
+	for _, child := range op.Children {
+		s += " " + child.String()
+	}
+	return s + " )"
+}
+
+func init() {
+	Register(OpSpec{Name: "+", Arity: 2, New: func() Node { return NewOpPlus() }, Weight: 1,
+		Eval:  func(a []float32) float32 { return a[0] + a[1] },
+		Range: func(a []Interval) Interval { return addRange(a[0], a[1]) }})
+	Register(OpSpec{Name: "-", Arity: 2, New: func() Node { return NewOpMinus() }, Weight: 1,
+		Eval:  func(a []float32) float32 { return a[0] - a[1] },
+		Range: func(a []Interval) Interval { return subRange(a[0], a[1]) }})
+	Register(OpSpec{Name: "*", Arity: 2, New: func() Node { return NewOpMultiplies() }, Weight: 1,
+		Eval:  func(a []float32) float32 { return a[0] * a[1] },
+		Range: func(a []Interval) Interval { return mulRange(a[0], a[1]) }})
+	Register(OpSpec{Name: "/", Arity: 2, New: func() Node { return NewOpDivide() }, Weight: 1,
+		Eval:  func(a []float32) float32 { return a[0] / a[1] },
+		Range: func(a []Interval) Interval { return divRange(a[0], a[1]) }})
+	// atan2 works on x and y rather than its children, so it has no Eval
+	Register(OpSpec{Name: "atan2", Arity: 2, New: func() Node { return NewOpAtan2() }, Weight: 1, Cost: 4})
+	Register(OpSpec{Name: "atan", Arity: 1, New: func() Node { return NewOpAtan() }, Weight: 1, Cost: 2,
+		Eval:  func(a []float32) float32 { return float32(math.Atan(float64(a[0]))) },
+		Range: func(a []Interval) Interval { return increasing(a[0], math.Atan) }})
+	Register(OpSpec{Name: "sin", Arity: 1, New: func() Node { return NewOpSin() }, Weight: 1, Cost: 2,
+		Eval:  func(a []float32) float32 { return float32(math.Sin(float64(a[0]))) },
+		Range: func(a []Interval) Interval { return periodic(a[0], math.Sin, math.Pi/2, -math.Pi/2) }})
+	Register(OpSpec{Name: "cos", Arity: 1, New: func() Node { return NewOpCos() }, Weight: 1, Cost: 2,
+		Eval:  func(a []float32) float32 { return float32(math.Cos(float64(a[0]))) },
+		Range: func(a []Interval) Interval { return periodic(a[0], math.Cos, 0, math.Pi) }})
+	Register(OpSpec{Name: "snoise2", Arity: 2, New: func() Node { return NewOpNoise() }, Weight: 1, Cost: 4,
+		Eval:  func(a []float32) float32 { return float32(80*noise.Snoise2(a[0], a[1])) - 2.0 },
+		Range: constRange(-80*snoiseBound-2, 80*snoiseBound-2)})
+	Register(OpSpec{Name: "ceil", Arity: 1, New: func() Node { return NewOpCeil() }, Weight: 1,
+		Eval:  func(a []float32) float32 { return float32(math.Ceil(float64(a[0]))) },
+		Range: func(a []Interval) Interval { return increasing(a[0], math.Ceil) }})
+	Register(OpSpec{Name: "fbm", Arity: 6, New: func() Node { return NewOpFbm() }, Weight: 1, Cost: 5, Eval: fbm,
+		Defaults: []float32{defaultGain, defaultLacunarity, defaultOctaves},
+		Range:    fbmRange})
+	Register(OpSpec{Name: "turbulence", Arity: 6, New: func() Node { return NewTurbulence() }, Weight: 1, Cost: 4, Eval: turbulence,
+		Defaults: []float32{defaultGain, defaultLacunarity, defaultOctaves},
+		Range:    turbulenceRange})
+	Register(OpSpec{Name: "floor", Arity: 1, New: func() Node { return NewOpFloor() }, Weight: 1,
+		Eval:  func(a []float32) float32 { return float32(math.Floor(float64(a[0]))) },
+		Range: func(a []Interval) Interval { return increasing(a[0], math.Floor) }})
+	Register(OpSpec{Name: "negate", Arity: 1, New: func() Node { return NewOpNegate() }, Weight: 1,
+		Eval:  func(a []float32) float32 { return -a[0] },
+		Range: func(a []Interval) Interval { return Interval{-a[0].Max, -a[0].Min} }})
+	Register(OpSpec{Name: "square", Arity: 1, New: func() Node { return NewOpSquare() }, Weight: 1,
+		Eval:  func(a []float32) float32 { return a[0] * a[0] },
+		Range: func(a []Interval) Interval { return squareRange(a[0]) }})
+	Register(OpSpec{Name: "abs", Arity: 1, New: func() Node { return NewOpAbs() }, Weight: 1,
+		Eval:  func(a []float32) float32 { return float32(math.Abs(float64(a[0]))) },
+		Range: func(a []Interval) Interval { return absRange(a[0]) }})
+
+	Register(OpSpec{Name: "pow", Arity: 2, New: func() Node { return NewOpPow() }, Weight: 1, Cost: 16,
+		Eval:  func(a []float32) float32 { return safePow(a[0], a[1]) },
+		Range: func(a []Interval) Interval { return powRange(a[0], a[1]) }})
+	Register(OpSpec{Name: "mod", Arity: 2, New: func() Node { return NewOpMod() }, Weight: 1, Cost: 2,
+		Eval:  func(a []float32) float32 { return safeMod(a[0], a[1]) },
+		Range: func(a []Interval) Interval { return modRange(a[0], a[1]) }})
+	Register(OpSpec{Name: "min", Arity: 2, New: func() Node { return NewOpMin() }, Weight: 1,
+		Eval:  func(a []float32) float32 { return min32(a[0], a[1]) },
+		Range: func(a []Interval) Interval { return minRange(a[0], a[1]) }})
+	Register(OpSpec{Name: "max", Arity: 2, New: func() Node { return NewOpMax() }, Weight: 1,
+		Eval:  func(a []float32) float32 { return max32(a[0], a[1]) },
+		Range: func(a []Interval) Interval { return maxRange(a[0], a[1]) }})
+	Register(OpSpec{Name: "step", Arity: 2, New: func() Node { return NewOpStep() }, Weight: 1,
+		Eval:  func(a []float32) float32 { return step(a[0], a[1]) },
+		Range: func(a []Interval) Interval { return stepRange(a[0], a[1]) }})
+	Register(OpSpec{Name: "mix", Arity: 3, New: func() Node { return NewOpMix() }, Weight: 1,
+		Eval:  func(a []float32) float32 { return mix(a[0], a[1], a[2]) },
+		Range: func(a []Interval) Interval { return mixRange(a[0], a[1], a[2]) }})
+	Register(OpSpec{Name: "clamp", Arity: 3, New: func() Node { return NewOpClamp() }, Weight: 1, Cost: 2,
+		Eval:  func(a []float32) float32 { return clamp32(a[0], a[1], a[2]) },
+		Range: func(a []Interval) Interval { return clampRange(a[0], a[1], a[2]) }})
+	Register(OpSpec{Name: "smoothstep", Arity: 3, New: func() Node { return NewOpSmoothstep() }, Weight: 1, Cost: 2,
+		Eval:  func(a []float32) float32 { return smoothstep(a[0], a[1], a[2]) },
+		Range: constRange(0, 1)})
+	Register(OpSpec{Name: "sqrt", Arity: 1, New: func() Node { return NewOpSqrt() }, Weight: 1,
+		Eval:  func(a []float32) float32 { return safeSqrt(a[0]) },
+		Range: func(a []Interval) Interval { return increasing(absRange(a[0]), math.Sqrt) }})
+	Register(OpSpec{Name: "log", Arity: 1, New: func() Node { return NewOpLog() }, Weight: 1, Cost: 4,
+		Eval:  func(a []float32) float32 { return safeLog(a[0]) },
+		Range: func(a []Interval) Interval { return logRange(a[0]) }})
+	Register(OpSpec{Name: "exp", Arity: 1, New: func() Node { return NewOpExp() }, Weight: 1, Cost: 2,
+		Eval: func(a []float32) float32 { return exp32(a[0]) },
+		Range: func(a []Interval) Interval {
+			return increasing(a[0], func(v float64) float64 { return math.Min(math.Exp(v), math.MaxFloat32) })
+		}})
+	Register(OpSpec{Name: "tan", Arity: 1, New: func() Node { return NewOpTan() }, Weight: 1, Cost: 2,
+		Eval:  func(a []float32) float32 { return tan32(a[0]) },
+		Range: func(a []Interval) Interval { return tanRange(a[0]) }})
+	Register(OpSpec{Name: "worleyf1", Arity: 2, New: func() Node { return NewOpWorleyF1() }, Weight: 1, Cost: 16,
+		Range: constRange(-1, 2*math.Sqrt2-1)})
+	Register(OpSpec{Name: "worleyf2", Arity: 2, New: func() Node { return NewOpWorleyF2() }, Weight: 1, Cost: 16,
+		Range: constRange(-1, float32(2*math.Sqrt(5)-1))})
+	Register(OpSpec{Name: "worleyf2f1", Arity: 2, New: func() Node { return NewOpWorleyEdge() }, Weight: 1, Cost: 18,
+		Range: constRange(-1, float32(2*math.Sqrt(5)-1))})
+	Register(OpSpec{Name: "valuenoise", Arity: 2, New: func() Node { return NewOpValueNoise() }, Weight: 1, Cost: 6,
+		Range: constRange(-1, 1)})
+	Register(OpSpec{Name: "ridged", Arity: 2, New: func() Node { return NewOpRidged() }, Weight: 1, Cost: 30,
+		Range: constRange(-1, 0.875)})
+
+	// the transforms move the coordinates their body sees, so they have no Eval
+	Register(OpSpec{Name: "warp", Arity: 3, New: func() Node { return NewOpWarp() }, Weight: 1})
+	Register(OpSpec{Name: "rotate", Arity: 2, New: func() Node { return NewOpRotate() }, Weight: 1, Cost: 4})
+	Register(OpSpec{Name: "scale", Arity: 2, New: func() Node { return NewOpScale() }, Weight: 1})
+	Register(OpSpec{Name: "polar", Arity: 1, New: func() Node { return NewOpPolar() }, Weight: 1, Cost: 5})
+
+	// the derivatives are worked out from their child as a whole, and grow
+	// several times bigger with each one nested in another, so they are
+	// never picked at random
+	Register(OpSpec{Name: "ddx", Arity: 1, New: func() Node { return NewOpDdx() }})
+	Register(OpSpec{Name: "ddy", Arity: 1, New: func() Node { return NewOpDdy() }})
+
+	Register(OpSpec{Name: "image", Arity: 2, New: func() Node { return NewOpImage() }, Weight: 1, Cost: 8,
+		Enabled: func() bool { return len(bitmaps) > 0 },
+		Range:   constRange(-1, 1)})
+
+	Register(OpSpec{Name: "x", New: func() Node { return NewOpX() }, Weight: 1})
+	Register(OpSpec{Name: "y", New: func() Node { return NewOpY() }, Weight: 1})
+	Register(OpSpec{Name: "t", New: func() Node { return NewOpT() }, Weight: 1,
+		Enabled: func() bool { return Animated }})
+	Register(OpSpec{Name: "picture", Arity: 3, New: func() Node { return NewOpPict() }})
+}
@@ -0,0 +1,204 @@
+package apt
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Simplify returns a simplified copy of node. Subtrees that don't depend on
+// x, y or t are folded into a single OpConst and a handful of algebraic
+// identities are applied. Every rewrite is exact, so the simplified tree
+// evaluates to the same value as the original at every point.
+func Simplify(node Node) Node {
+	return simplify(CopyTree(node, nil), true)
+}
+
+// simplify simplifies node in place. finiteXY says whether x and y are known
+// to be finite where node is, which they are at the root but not in the body
+// of a transform, whose moved coordinates can overflow or be NaN.
+func simplify(node Node, finiteXY bool) Node {
+	switch node.(type) {
+	case *OpDdx, *OpDdy:
+		// the derivative is worked out from the body as it is written, so
+		// simplifying it could change the result in the last bit
+		return node
+	}
+	children := node.GetChildren()
+	for i, child := range children {
+		children[i] = simplify(child, finiteXY && !(isTransform(node) && i == len(children)-1))
+	}
+
+	if isConstant(node) {
+		if _, ok := node.(*OpConst); !ok {
+			v := node.Eval(0, 0)
+			if savable(v) {
+				c := NewOpConst()
+				c.value = v
+				c.SetParent(node.GetParent())
+				return c
+			}
+		}
+	}
+
+	result := rewrite(node, finiteXY)
+	result.SetParent(node.GetParent())
+	return result
+}
+
+// rewrite applies the first identity that matches node, returning node itself
+// if none does.
+func rewrite(node Node, finiteXY bool) Node {
+	children := node.GetChildren()
+	switch node.(type) {
+	case *OpAtan2:
+		// atan2 always works on x and y, so its children are dead weight
+		y, x := NewOpY(), NewOpX()
+		y.SetParent(node)
+		x.SetParent(node)
+		children[0], children[1] = y, x
+	case *OpMinus:
+		// x - x is only 0 when x is finite, Inf - Inf is NaN
+		if finiteXY && isFinite(children[0]) && equalTrees(children[0], children[1]) {
+			c := NewOpConst()
+			c.value = 0
+			return c
+		}
+		if isConstValue(children[1], 0) {
+			return children[0]
+		}
+	case *OpMultiplies:
+		if isConstValue(children[1], 1) {
+			return children[0]
+		}
+		if isConstValue(children[0], 1) {
+			return children[1]
+		}
+	case *OpDivide:
+		if isConstValue(children[1], 1) {
+			return children[0]
+		}
+	case *OpNegate:
+		if inner, ok := children[0].(*OpNegate); ok {
+			return inner.Children[0]
+		}
+	case *OpAbs:
+		switch inner := children[0].(type) {
+		case *OpAbs, *OpSquare:
+			return inner
+		case *OpNegate:
+			return replaceChild(node, inner.Children[0], finiteXY)
+		}
+	case *OpSquare, *OpCos:
+		// both are even functions, so the sign of the argument doesn't matter
+		switch inner := children[0].(type) {
+		case *OpNegate:
+			return replaceChild(node, inner.Children[0], finiteXY)
+		case *OpAbs:
+			return replaceChild(node, inner.Children[0], finiteXY)
+		}
+	case *OpFloor, *OpCeil:
+		// rounding an already whole number leaves it as it is
+		switch inner := children[0].(type) {
+		case *OpFloor, *OpCeil:
+			return inner
+		}
+	case *OpWarp, *OpRotate, *OpScale, *OpPolar:
+		// moving the coordinates makes no difference to a constant body
+		if body, ok := children[len(children)-1].(*OpConst); ok {
+			return body
+		}
+	}
+	return node
+}
+
+// replaceChild swaps the only child of node for child and simplifies node
+// again, since the new child may open up another identity.
+func replaceChild(node, child Node, finiteXY bool) Node {
+	child.SetParent(node)
+	node.GetChildren()[0] = child
+	return rewrite(node, finiteXY)
+}
+
+// isTransform reports whether node evaluates its last child, the body, at
+// moved coordinates.
+func isTransform(node Node) bool {
+	switch node.(type) {
+	case *OpWarp, *OpRotate, *OpScale, *OpPolar:
+		return true
+	}
+	return false
+}
+
+// isConstant reports whether node evaluates to the same value everywhere.
+// Only operators with an Eval in their spec, and funcNodes, are known to
+// depend on nothing but their children.
+func isConstant(node Node) bool {
+	if _, ok := node.(*OpConst); ok {
+		return true
+	}
+	if _, ok := node.(funcNode); !ok {
+		if s := specOf(node); s == nil || s.Eval == nil {
+			return false
+		}
+	}
+	for _, child := range node.GetChildren() {
+		if !isConstant(child) {
+			return false
+		}
+	}
+	return true
+}
+
+// isFinite reports whether node is guaranteed to give a finite value for
+// finite x and y.
+func isFinite(node Node) bool {
+	switch n := node.(type) {
+	case *OpX, *OpY, *OpT, *OpAtan2:
+		return true
+	case *OpConst:
+		return !math.IsInf(float64(n.value), 0) && !math.IsNaN(float64(n.value))
+	case *OpSin, *OpCos, *OpAtan, *OpNegate, *OpAbs, *OpCeil, *OpFloor:
+		return isFinite(n.GetChildren()[0])
+	}
+	return false
+}
+
+// savable reports whether v is finite and survives being written out by
+// OpConst.String and parsed back, so folding it doesn't change a saved tree.
+func savable(v float32) bool {
+	if math.IsInf(float64(v), 0) || math.IsNaN(float64(v)) {
+		return false
+	}
+	c := &OpConst{value: v}
+	parsed, err := strconv.ParseFloat(c.String(), 32)
+	return err == nil && float32(parsed) == v
+}
+
+func isConstValue(node Node, v float32) bool {
+	c, ok := node.(*OpConst)
+	return ok && c.value == v && !math.Signbit(float64(c.value))
+}
+
+func equalTrees(a, b Node) bool {
+	if ca, ok := a.(*OpConst); ok {
+		cb, ok := b.(*OpConst)
+		return ok && math.Float32bits(ca.value) == math.Float32bits(cb.value)
+	}
+	if sa := specOf(a); sa == nil || sa != specOf(b) {
+		return false
+	}
+	if pa, ok := a.(ParamNode); ok && strings.Join(pa.Params(), " ") != strings.Join(b.(ParamNode).Params(), " ") {
+		return false
+	}
+	aChildren, bChildren := a.GetChildren(), b.GetChildren()
+	if len(aChildren) != len(bChildren) {
+		return false
+	}
+	for i := range aChildren {
+		if !equalTrees(aChildren[i], bChildren[i]) {
+			return false
+		}
+	}
+	return true
+}
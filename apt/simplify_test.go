@@ -0,0 +1,39 @@
+package apt
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestSimplifyMatchesEval(t *testing.T) {
+	trees := []Node{}
+	for _, src := range []string{
+		// the body of a transform can see NaN coordinates, where y - y
+		// isn't 0
+		"( scale ( / y y ) ( - y y ) )",
+		"( warp ( / x 0 ) 0 ( - x x ) )",
+	} {
+		tree, err := Parse(strings.NewReader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		trees = append(trees, tree)
+	}
+	r := rand.New(rand.NewSource(5))
+	for i := 0; i < 300; i++ {
+		trees = append(trees, randomTree(r))
+	}
+
+	points := samplePoints(16)
+	for _, tree := range trees {
+		simplified := Simplify(tree)
+		for _, y := range points {
+			for _, x := range points {
+				if got, want := simplified.Eval(x, y), tree.Eval(x, y); !sameFloat(got, want) {
+					t.Fatalf("simplified gives %v at %v, %v, the tree gives %v\n%s\n%s", got, x, y, want, tree, simplified)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package apt
+
+// TreeStats describes the size and shape of a tree, see Stats.
+type TreeStats struct {
+	Nodes int `json:"nodes"`
+	// Depth is the number of nodes on the longest path down from the root,
+	// 1 for a leaf.
+	Depth int `json:"depth"`
+	// Operators counts the nodes of each operator, constants under const.
+	Operators map[string]int `json:"operators"`
+	// ConstantShare is the share of the nodes that are in a subtree of an
+	// operator that only depends on constants, which Simplify can fold.
+	ConstantShare float64 `json:"constantShare"`
+	// Cost estimates the work of evaluating the tree at a point once it is
+	// compiled, counting an addition as 1, from the Cost of the operators.
+	Cost float64 `json:"cost"`
+}
+
+// Stats measures the tree under node.
+func Stats(node Node) TreeStats {
+	s := TreeStats{Nodes: node.CountNode(), Operators: map[string]int{}}
+	var constants int
+	s.Depth = s.walk(node, &constants)
+	s.ConstantShare = float64(constants) / float64(s.Nodes)
+	s.Cost = cost(node)
+	return s
+}
+
+// walk counts the operators under node, adding the nodes of the constant
+// subtrees it finds to constants, and returns the depth of node.
+func (s *TreeStats) walk(node Node, constants *int) int {
+	children := node.GetChildren()
+	if _, ok := node.(*OpConst); ok {
+		s.Operators[constOp]++
+	} else {
+		s.Operators[nodeName(node)]++
+		if len(children) > 0 && isConstant(node) {
+			*constants += node.CountNode()
+			// the subtrees below are constant too, but already counted
+			constants = new(int)
+		}
+	}
+	depth := 0
+	for _, child := range children {
+		if d := s.walk(child, constants); d > depth {
+			depth = d
+		}
+	}
+	return depth + 1
+}
+
+// cost adds up the Cost of the operators under node. The derivatives cost
+// what the tree they are worked out as does, and fbm and turbulence cost
+// their octaves, or as many as they can have when that isn't constant.
+func cost(node Node) float64 {
+	switch n := node.(type) {
+	case *OpConst:
+		return 0
+	case *OpDdx:
+		return cost(n.derived())
+	case *OpDdy:
+		return cost(n.derived())
+	}
+
+	total := 1.0
+	if s := specOf(node); s != nil && s.Cost != 0 {
+		total = s.Cost
+	}
+	children := node.GetChildren()
+	switch node.(type) {
+	case *OpFbm, *OpTurbulence:
+		octaves := maxOctaves
+		if isConstant(children[5]) {
+			octaves = octaveCount(children[5].Eval(0, 0))
+		}
+		total *= float64(octaves)
+	}
+	for _, child := range children {
+		total += cost(child)
+	}
+	return total
+}
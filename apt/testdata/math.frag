@@ -0,0 +1,274 @@
+#version 330 core
+
+// Generated by evolving-pictures.
+
+uniform vec2 resolution;
+uniform float time;
+
+out vec4 fragColor;
+
+const int perm[256] = int[256](
+	151, 160, 137, 91, 90, 15, 131, 13, 201, 95, 96, 53, 194, 233, 7, 225,
+	140, 36, 103, 30, 69, 142, 8, 99, 37, 240, 21, 10, 23, 190, 6, 148,
+	247, 120, 234, 75, 0, 26, 197, 62, 94, 252, 219, 203, 117, 35, 11, 32,
+	57, 177, 33, 88, 237, 149, 56, 87, 174, 20, 125, 136, 171, 168, 68, 175,
+	74, 165, 71, 134, 139, 48, 27, 166, 77, 146, 158, 231, 83, 111, 229, 122,
+	60, 211, 133, 230, 220, 105, 92, 41, 55, 46, 245, 40, 244, 102, 143, 54,
+	65, 25, 63, 161, 1, 216, 80, 73, 209, 76, 132, 187, 208, 89, 18, 169,
+	200, 196, 135, 130, 116, 188, 159, 86, 164, 100, 109, 198, 173, 186, 3, 64,
+	52, 217, 226, 250, 124, 123, 5, 202, 38, 147, 118, 126, 255, 82, 85, 212,
+	207, 206, 59, 227, 47, 16, 58, 17, 182, 189, 28, 42, 223, 183, 170, 213,
+	119, 248, 152, 2, 44, 154, 163, 70, 221, 153, 101, 155, 167, 43, 172, 9,
+	129, 22, 39, 253, 19, 98, 108, 110, 79, 113, 224, 232, 178, 185, 112, 104,
+	218, 246, 97, 228, 251, 34, 242, 193, 238, 210, 144, 12, 191, 179, 162, 241,
+	81, 51, 145, 235, 249, 14, 239, 107, 49, 192, 214, 31, 181, 199, 106, 157,
+	184, 84, 204, 176, 115, 121, 50, 45, 127, 4, 150, 254, 138, 236, 205, 93,
+	222, 114, 67, 29, 24, 72, 243, 141, 128, 195, 78, 66, 215, 61, 156, 180);
+
+int fastFloor(float x) {
+	int i = int(x);
+	return float(i) <= x ? i : i - 1;
+}
+
+float grad2(int hash, float x, float y) {
+	int h = hash & 7;
+	float u = y;
+	float v = 2.0 * x;
+	if (h < 4) {
+		u = x;
+		v = 2.0 * y;
+	}
+	if ((h & 1) != 0) {
+		u = -u;
+	}
+	if ((h & 2) != 0) {
+		v = -v;
+	}
+	return u + v;
+}
+
+float snoise2(float x, float y) {
+	const float F2 = 0.366025403;
+	const float G2 = 0.211324865;
+	float s = (x + y) * F2;
+	int i = fastFloor(x + s);
+	int j = fastFloor(y + s);
+	float t = float(i + j) * G2;
+	float x0 = x - (float(i) - t);
+	float y0 = y - (float(j) - t);
+	int i1 = 0;
+	int j1 = 1;
+	if (x0 > y0) {
+		i1 = 1;
+		j1 = 0;
+	}
+	float x1 = x0 - float(i1) + G2;
+	float y1 = y0 - float(j1) + G2;
+	float x2 = x0 - 1.0 + 2.0 * G2;
+	float y2 = y0 - 1.0 + 2.0 * G2;
+	int ii = i & 255;
+	int jj = j & 255;
+
+	float n0 = 0.0;
+	float n1 = 0.0;
+	float n2 = 0.0;
+	float t0 = 0.5 - x0 * x0 - y0 * y0;
+	if (t0 >= 0.0) {
+		t0 *= t0;
+		n0 = t0 * t0 * grad2(perm[(ii + perm[jj]) & 255], x0, y0);
+	}
+	float t1 = 0.5 - x1 * x1 - y1 * y1;
+	if (t1 >= 0.0) {
+		t1 *= t1;
+		n1 = t1 * t1 * grad2(perm[(ii + i1 + perm[(jj + j1) & 255]) & 255], x1, y1);
+	}
+	float t2 = 0.5 - x2 * x2 - y2 * y2;
+	if (t2 >= 0.0) {
+		t2 *= t2;
+		n2 = t2 * t2 * grad2(perm[(ii + 1 + perm[(jj + 1) & 255]) & 255], x2, y2);
+	}
+	return n0 + n1 + n2;
+}
+
+int octaveCount(float v) {
+	if (!(v >= 1.0)) {
+		return 1;
+	}
+	if (v >= 8.0) {
+		return 8;
+	}
+	return int(v + 0.5);
+}
+
+float fbm(float x, float y, float frequency, float gain, float lacunarity, float octaves) {
+	int n = octaveCount(octaves);
+	float sum = 0.0;
+	float amplitude = 1.0;
+	for (int i = 0; i < n; i++) {
+		sum += snoise2(x * frequency, y * frequency) * amplitude;
+		frequency *= lacunarity;
+		amplitude *= gain;
+	}
+	return sum;
+}
+
+float turbulence(float x, float y, float frequency, float gain, float lacunarity, float octaves) {
+	int n = octaveCount(octaves);
+	float sum = 0.0;
+	float amplitude = 1.0;
+	for (int i = 0; i < n; i++) {
+		sum += abs(snoise2(x * frequency, y * frequency) * amplitude);
+		frequency *= lacunarity;
+		amplitude *= gain;
+	}
+	return sum;
+}
+
+uint hash2(int ix, int iy, uint seed) {
+	uint h = seed ^ uint(ix) * 0x27d4eb2du ^ uint(iy) * 0x165667b1u;
+	h ^= h >> 15;
+	h *= 0x85ebca6bu;
+	h ^= h >> 13;
+	h *= 0xc2b2ae35u;
+	h ^= h >> 16;
+	return h;
+}
+
+float unitFloat(uint h) {
+	return float(h >> 8) / 16777216.0;
+}
+
+void lattice(float v, out int i, out float f) {
+	v = clamp(v, -1073741824.0, 1073741824.0);
+	float fl = floor(v);
+	i = int(fl);
+	f = v - fl;
+}
+
+vec2 worley(uint seed, float x, float y) {
+	if (isnan(x) || isnan(y)) {
+		return vec2(x + y);
+	}
+	int ix, iy;
+	float fx, fy;
+	lattice(x, ix, fx);
+	lattice(y, iy, fy);
+	float f1 = uintBitsToFloat(0x7f800000u);
+	float f2 = f1;
+	for (int dy = -1; dy <= 1; dy++) {
+		for (int dx = -1; dx <= 1; dx++) {
+			uint h = hash2(ix + dx, iy + dy, seed);
+			float px = float(dx) + unitFloat(h) - fx;
+			float py = float(dy) + unitFloat(hash2(ix + dx, iy + dy, h)) - fy;
+			float d = sqrt(px * px + py * py);
+			if (d < f1) {
+				f2 = f1;
+				f1 = d;
+			} else if (d < f2) {
+				f2 = d;
+			}
+		}
+	}
+	return vec2(f1, f2);
+}
+
+float worleyF1(uint seed, float x, float y) {
+	return worley(seed, x, y).x * 2.0 - 1.0;
+}
+
+float worleyF2(uint seed, float x, float y) {
+	return worley(seed, x, y).y * 2.0 - 1.0;
+}
+
+float worleyEdge(uint seed, float x, float y) {
+	vec2 f = worley(seed, x, y);
+	return (f.y - f.x) * 2.0 - 1.0;
+}
+
+float latticeValue(int ix, int iy, uint seed) {
+	return unitFloat(hash2(ix, iy, seed)) * 2.0 - 1.0;
+}
+
+float valueNoise(uint seed, float x, float y) {
+	int ix, iy;
+	float fx, fy;
+	lattice(x, ix, fx);
+	lattice(y, iy, fy);
+	float sx = fx * fx * (3.0 - 2.0 * fx);
+	float sy = fy * fy * (3.0 - 2.0 * fy);
+	float top = latticeValue(ix, iy, seed) + (latticeValue(ix + 1, iy, seed) - latticeValue(ix, iy, seed)) * sx;
+	float bottom = latticeValue(ix, iy + 1, seed) + (latticeValue(ix + 1, iy + 1, seed) - latticeValue(ix, iy + 1, seed)) * sx;
+	return top + (bottom - top) * sy;
+}
+
+float ridged(uint seed, float x, float y) {
+	float ox = unitFloat(hash2(0, 0, seed)) * 256.0;
+	float oy = unitFloat(hash2(1, 0, seed)) * 256.0;
+	float result = 0.0;
+	float weight = 1.0;
+	float amplitude = 1.0;
+	for (int i = 0; i < 4; i++) {
+		float n = 40.0 * snoise2(x + ox, y + oy);
+		float signal = 1.0 - abs(n);
+		signal *= signal * weight;
+		result += signal * amplitude;
+		weight = clamp(signal * 2.0, 0.0, 1.0);
+		x *= 2.0;
+		y *= 2.0;
+		amplitude /= 2.0;
+	}
+	return result - 1.0;
+}
+
+float safePow(float a, float b) {
+	return a == 0.0 ? 0.0 : min(pow(abs(a), b), 3.40282347e38);
+}
+
+float safeMod(float a, float b) {
+	return b == 0.0 ? 0.0 : a - b * floor(a / b);
+}
+
+float clamp32(float v, float lo, float hi) {
+	return clamp(v, min(lo, hi), max(lo, hi));
+}
+
+float smoothstep32(float e0, float e1, float a) {
+	if (e0 == e1) {
+		return step(e0, a);
+	}
+	float t = clamp((a - e0) / (e1 - e0), 0.0, 1.0);
+	return t * t * (3.0 - 2.0 * t);
+}
+
+float safeSqrt(float a) {
+	return sqrt(abs(a));
+}
+
+float safeLog(float a) {
+	return a == 0.0 ? 0.0 : log(abs(a));
+}
+
+float exp32(float a) {
+	return min(exp(a), 3.40282347e38);
+}
+
+float tan32(float a) {
+	return clamp(tan(a), -10000.0, 10000.0);
+}
+
+void main() {
+	float x = (gl_FragCoord.x - 0.5) / resolution.x * 2.0 - 1.0;
+	float y = 1.0 - (gl_FragCoord.y + 0.5) / resolution.y * 2.0;
+	float v0 = x * 100.0;
+	float v1 = exp32(v0);
+	float v2 = y * 2.0;
+	float v3 = tan32(v2);
+	float v4 = x * 100.0;
+	float v5 = safePow(10.0, v4);
+	float v6 = safeLog(y);
+	float v7 = safeSqrt(x);
+	float v8 = max(x, time);
+	float v9 = clamp32(v6, v7, v8);
+	float v10 = v5 + v9;
+	fragColor = vec4(clamp(vec3(v1, v3, v10) * 0.5 + 0.5, 0.0, 1.0), 1.0);
+}
@@ -0,0 +1,139 @@
+package apt
+
+import "math"
+
+// The nodes in this file evaluate their last child, the body, at different
+// coordinates than their own. Their other children are evaluated at the
+// original coordinates and say how to move them.
+
+func rotate(x, y, angle float32) (float32, float32) {
+	sin, cos := math.Sincos(float64(angle))
+	return float32(float64(float64(x)*cos) - float64(float64(y)*sin)), float32(float64(float64(x)*sin) + float64(float64(y)*cos))
+}
+
+// toPolar turns x and y into the distance from the origin and the angle
+// divided by pi, so both stay about as big as x and y.
+func toPolar(x, y float32) (float32, float32) {
+	return float32(math.Hypot(float64(x), float64(y))), float32(math.Atan2(float64(y), float64(x)) / math.Pi)
+}
+
+// evalRowAt evaluates node at each of the points (xs[i], ys[i]). Nodes can
+// only evaluate a row at a single y, so this goes point by point.
+func evalRowAt(node Node, xs, ys, out []float32) {
+	for i := range out {
+		out[i] = node.Eval(xs[i], ys[i])
+	}
+}
+
+type OpWarp struct {
+	BaseNode
+}
+
+func NewOpWarp() *OpWarp {
+	return &OpWarp{BaseNode{nil, make([]Node, 3)}}
+}
+
+func (op *OpWarp) Eval(x, y float32) float32 {
+	dx := op.Children[0].Eval(x, y)
+	dy := op.Children[1].Eval(x, y)
+	return op.Children[2].Eval(x+dx, y+dy)
+}
+
+func (op *OpWarp) EvalRow(xs []float32, y float32, out []float32) {
+	s := getRows(2, len(xs))
+	defer s.release()
+	dx, dy := s.rows[0], s.rows[1]
+	op.Children[0].EvalRow(xs, y, dx)
+	op.Children[1].EvalRow(xs, y, dy)
+	for i := range dx {
+		dx[i] = xs[i] + dx[i]
+		dy[i] = y + dy[i]
+	}
+	evalRowAt(op.Children[2], dx, dy, out)
+}
+
+func (op *OpWarp) String() string {
+	return "( warp " + op.Children[0].String() + " " + op.Children[1].String() + " " + op.Children[2].String() + " )"
+}
+
+type OpRotate struct {
+	BaseNode
+}
+
+func NewOpRotate() *OpRotate {
+	return &OpRotate{BaseNode{nil, make([]Node, 2)}}
+}
+
+func (op *OpRotate) Eval(x, y float32) float32 {
+	rx, ry := rotate(x, y, op.Children[0].Eval(x, y))
+	return op.Children[1].Eval(rx, ry)
+}
+
+func (op *OpRotate) EvalRow(xs []float32, y float32, out []float32) {
+	s := getRows(2, len(xs))
+	defer s.release()
+	rxs, rys := s.rows[0], s.rows[1]
+	op.Children[0].EvalRow(xs, y, rxs)
+	for i := range rxs {
+		rxs[i], rys[i] = rotate(xs[i], y, rxs[i])
+	}
+	evalRowAt(op.Children[1], rxs, rys, out)
+}
+
+func (op *OpRotate) String() string {
+	return "( rotate " + op.Children[0].String() + " " + op.Children[1].String() + " )"
+}
+
+type OpScale struct {
+	BaseNode
+}
+
+func NewOpScale() *OpScale {
+	return &OpScale{BaseNode{nil, make([]Node, 2)}}
+}
+
+func (op *OpScale) Eval(x, y float32) float32 {
+	s := op.Children[0].Eval(x, y)
+	return op.Children[1].Eval(x*s, y*s)
+}
+
+func (op *OpScale) EvalRow(xs []float32, y float32, out []float32) {
+	s := getRows(2, len(xs))
+	defer s.release()
+	sxs, sys := s.rows[0], s.rows[1]
+	op.Children[0].EvalRow(xs, y, sxs)
+	for i, scale := range sxs {
+		sxs[i], sys[i] = xs[i]*scale, y*scale
+	}
+	evalRowAt(op.Children[1], sxs, sys, out)
+}
+
+func (op *OpScale) String() string {
+	return "( scale " + op.Children[0].String() + " " + op.Children[1].String() + " )"
+}
+
+type OpPolar struct {
+	BaseNode
+}
+
+func NewOpPolar() *OpPolar {
+	return &OpPolar{BaseNode{nil, make([]Node, 1)}}
+}
+
+func (op *OpPolar) Eval(x, y float32) float32 {
+	return op.Children[0].Eval(toPolar(x, y))
+}
+
+func (op *OpPolar) EvalRow(xs []float32, y float32, out []float32) {
+	s := getRows(2, len(xs))
+	defer s.release()
+	rs, thetas := s.rows[0], s.rows[1]
+	for i, x := range xs {
+		rs[i], thetas[i] = toPolar(x, y)
+	}
+	evalRowAt(op.Children[0], rs, thetas, out)
+}
+
+func (op *OpPolar) String() string {
+	return "( polar " + op.Children[0].String() + " )"
+}
@@ -0,0 +1,594 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	. "github.com/ahmadfarhanstwn/evolving-pictures/apt"
+)
+
+// commands are run instead of opening the window when their name is the first
+// argument, e.g. evolving-pictures fmt 0.apt
+var commands = map[string]func(args []string) error{
+	"fmt":         fmtCommand,
+	"animate":     animateCommand,
+	"export-glsl": exportGLSLCommand,
+	"export-go":   exportGoCommand,
+	"json":        jsonCommand,
+	"diff":        diffCommand,
+	"lineage":     lineageCommand,
+	"stats":       statsCommand,
+	"gene":        geneCommand,
+	"evolve":      evolveCommand,
+}
+
+func fmtCommand(args []string) error {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	width := flags.Int("width", DefaultFormatOptions.Width, "break up subtrees longer than this")
+	indent := flags.String("indent", DefaultFormatOptions.Indent, "indentation for each level of nesting")
+	precision := flags.Int("precision", DefaultFormatOptions.Precision, "digits after the decimal point of constants")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: evolving-pictures fmt [flags] file.apt...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	opts := FormatOptions{Width: *width, Indent: *indent, Precision: *precision}
+	for _, fileName := range flags.Args() {
+		fileBytes, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return err
+		}
+		node, err := Parse(bytes.NewReader(fileBytes))
+		if err != nil {
+			return fmt.Errorf("%s:%v", fileName, err)
+		}
+		formatted := Format(node, opts)
+		if formatted == string(fileBytes) {
+			continue
+		}
+		if err := ioutil.WriteFile(fileName, []byte(formatted), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func animateCommand(args []string) error {
+	flags := flag.NewFlagSet("animate", flag.ExitOnError)
+	frames := flags.Int("frames", 30, "number of frames to render")
+	from := flags.Float64("from", 0, "time of the first frame")
+	to := flags.Float64("to", 1, "time of the last frame")
+	width := flags.Int("width", winWidth, "frame width")
+	height := flags.Int("height", winHeight, "frame height")
+	fps := flags.Int("fps", 20, "frames per second of the gif, from 1 to 100 as gifs count time in hundredths of a second")
+	gifName := flags.String("gif", "", "write an animated gif to this file")
+	pngDir := flags.String("png", "", "write the frames as numbered pngs into this directory")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: evolving-pictures animate [flags] file.apt")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 || (*gifName == "" && *pngDir == "") || *frames < 1 || *fps < 1 || *fps > 100 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	p, err := loadPicture(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *pngDir != "" {
+		if err := os.MkdirAll(*pngDir, 0755); err != nil {
+			return err
+		}
+	}
+
+	anim := &gif.GIF{}
+	for i := 0; i < *frames; i++ {
+		t := *from
+		if *frames > 1 {
+			t += (*to - *from) * float64(i) / float64(*frames-1)
+		}
+		img := pixelsToImage(aptToPixelsAt(p, *width, *height, float32(t)), *width, *height)
+
+		if *pngDir != "" {
+			if err := savePNG(filepath.Join(*pngDir, fmt.Sprintf("frame_%04d.png", i)), img); err != nil {
+				return err
+			}
+		}
+		if *gifName != "" {
+			paletted := image.NewPaletted(img.Bounds(), palette.Plan9)
+			draw.FloydSteinberg.Draw(paletted, img.Bounds(), img, image.Point{})
+			anim.Image = append(anim.Image, paletted)
+			anim.Delay = append(anim.Delay, 100 / *fps)
+		}
+	}
+
+	if *gifName != "" {
+		file, err := os.Create(*gifName)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return gif.EncodeAll(file, anim)
+	}
+	return nil
+}
+
+func exportGLSLCommand(args []string) error {
+	flags := flag.NewFlagSet("export-glsl", flag.ExitOnError)
+	out := flags.String("o", "", "write the shader to this file instead of next to the picture")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: evolving-pictures export-glsl [flags] file.apt...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 || (*out != "" && flags.NArg() > 1) {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	for _, fileName := range flags.Args() {
+		p, err := loadPicture(fileName)
+		if err != nil {
+			return err
+		}
+		shader, err := GLSL(p.r, p.g, p.b)
+		if err != nil {
+			return fmt.Errorf("%s: %v", fileName, err)
+		}
+		fragName := *out
+		if fragName == "" {
+			fragName = strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".frag"
+		}
+		if err := ioutil.WriteFile(fragName, []byte(shader), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pixelsToImage wraps pixels from aptToPixels in an image, filling in the
+// alpha channel that the textures don't use.
+func pixelsToImage(pixels []byte, w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	copy(img.Pix, pixels)
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 255
+	}
+	return img
+}
+
+func savePNG(fileName string, img image.Image) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(file, img); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func exportGoCommand(args []string) error {
+	flags := flag.NewFlagSet("export-go", flag.ExitOnError)
+	out := flags.String("o", "", "write the source to this file instead of next to the picture")
+	pkg := flags.String("pkg", "pictures", "package of the generated file")
+	funcName := flags.String("func", "Picture", "name of the generated function")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: evolving-pictures export-go [flags] file.apt")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	fileName := flags.Arg(0)
+	p, err := loadPicture(fileName)
+	if err != nil {
+		return err
+	}
+	pict := NewOpPict()
+	pict.SetChildren([]Node{p.r, p.g, p.b})
+	src, err := GenerateGo(pict, *pkg, *funcName)
+	if err != nil {
+		return fmt.Errorf("%s: %v", fileName, err)
+	}
+	goName := *out
+	if goName == "" {
+		goName = strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".go"
+	}
+	return ioutil.WriteFile(goName, src, 0644)
+}
+
+func jsonCommand(args []string) error {
+	flags := flag.NewFlagSet("json", flag.ExitOnError)
+	out := flags.String("o", "", "write the JSON to this file instead of next to the picture")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: evolving-pictures json [flags] file.apt...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 || (*out != "" && flags.NArg() > 1) {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	for _, fileName := range flags.Args() {
+		p, err := loadPicture(fileName)
+		if err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(p, "", "  ")
+		if err != nil {
+			return fmt.Errorf("%s: %v", fileName, err)
+		}
+		jsonName := *out
+		if jsonName == "" {
+			jsonName = strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".json"
+		}
+		if err := ioutil.WriteFile(jsonName, append(data, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func diffCommand(args []string) error {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	color := flags.Bool("color", isTerminal(os.Stdout), "color the output")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: evolving-pictures diff [flags] old.apt new.apt")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var trees [2]Node
+	for i, fileName := range flags.Args() {
+		p, err := loadPicture(fileName)
+		if err != nil {
+			return err
+		}
+		trees[i] = NewOpPict()
+		trees[i].SetChildren([]Node{p.r, p.g, p.b})
+	}
+
+	paint := func(code, s string) string {
+		if !*color {
+			return s
+		}
+		return "\x1b[" + code + "m" + s + "\x1b[0m"
+	}
+	// prefix puts the sign in front of every line of the formatted subtree
+	prefix := func(sign string, node Node) string {
+		lines := strings.Split(strings.TrimSuffix(Format(node, DefaultFormatOptions), "\n"), "\n")
+		return sign + " " + strings.Join(lines, "\n"+sign+" ")
+	}
+	for _, change := range Diff(trees[0], trees[1]) {
+		// the first step down from the picture picks the channel
+		header := channelPath(change.Path[0], change.Path[1:]) + " " + change.Kind.String()
+		switch change.Kind {
+		case Inserted:
+			header += fmt.Sprintf(", the old subtree is now child %d", change.Kept)
+		case Deleted:
+			header += fmt.Sprintf(", child %d took its place", change.Kept)
+		}
+		fmt.Println(paint("36", header))
+		fmt.Println(paint("31", prefix("-", change.Old)))
+		fmt.Println(paint("32", prefix("+", change.New)))
+	}
+	return nil
+}
+
+// isTerminal reports whether f looks like a terminal rather than a file or a
+// pipe.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func lineageCommand(args []string) error {
+	flags := flag.NewFlagSet("lineage", flag.ExitOnError)
+	historyName := flags.String("history", *historyFile, "history file the pictures were recorded in")
+	out := flags.String("o", "", "write to this file instead of printing, a contact sheet of thumbnails if it ends in .png and a DOT graph otherwise")
+	size := flags.Int("size", 128, "width and height of the thumbnails in the contact sheet")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: evolving-pictures lineage [flags] file.apt|id")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 || *size <= 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	records, files, err := readHistory(*historyName)
+	if err != nil {
+		return err
+	}
+	id, ok := files[filepath.Clean(flags.Arg(0))]
+	if !ok {
+		id = flags.Arg(0)
+	}
+	if _, ok := records[id]; !ok {
+		return fmt.Errorf("%s isn't in %s", flags.Arg(0), *historyName)
+	}
+
+	// the ancestors, the picture itself first and then back a generation at
+	// a time
+	ancestors := []historyRecord{records[id]}
+	seen := map[string]bool{id: true}
+	for i := 0; i < len(ancestors); i++ {
+		for _, parent := range ancestors[i].Parents {
+			if record, ok := records[parent]; ok && !seen[parent] {
+				seen[parent] = true
+				ancestors = append(ancestors, record)
+			}
+		}
+	}
+	sort.SliceStable(ancestors, func(i, j int) bool {
+		return ancestors[i].Generation > ancestors[j].Generation
+	})
+
+	if strings.EqualFold(filepath.Ext(*out), ".png") {
+		return savePNG(*out, contactSheet(ancestors, *size))
+	}
+	dot := lineageDOT(ancestors, records)
+	if *out == "" {
+		fmt.Print(dot)
+		return nil
+	}
+	return ioutil.WriteFile(*out, []byte(dot), 0644)
+}
+
+// lineageDOT draws the ancestry as a graph from the parents to their
+// children, the edges labeled with the nodes the operator worked on.
+func lineageDOT(ancestors []historyRecord, records map[string]historyRecord) string {
+	var sb strings.Builder
+	sb.WriteString("digraph lineage {\n\tnode [shape=box];\n")
+	for _, record := range ancestors {
+		fmt.Fprintf(&sb, "\t%q [label=%q];\n", record.ID, fmt.Sprintf("%s\ngeneration %d\n%s", record.ID, record.Generation, record.Operator))
+		for i, parent := range record.Parents {
+			if _, ok := records[parent]; !ok {
+				// left out of the history, or from a history since removed
+				fmt.Fprintf(&sb, "\t%q [label=%q, style=dashed];\n", parent, parent+"\nnot in the history")
+			}
+			label := ""
+			if i < len(record.Paths) {
+				label = record.Paths[i]
+			}
+			fmt.Fprintf(&sb, "\t%q -> %q [label=%q];\n", parent, record.ID, label)
+		}
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// contactSheet draws a row of thumbnails per generation, the picture at the
+// top and its oldest ancestors at the bottom, and prints the IDs in the
+// same layout.
+func contactSheet(ancestors []historyRecord, size int) *image.RGBA {
+	var rows [][]historyRecord
+	for i, record := range ancestors {
+		if i == 0 || record.Generation != ancestors[i-1].Generation {
+			rows = append(rows, nil)
+		}
+		rows[len(rows)-1] = append(rows[len(rows)-1], record)
+	}
+	columns := 0
+	for _, row := range rows {
+		if len(row) > columns {
+			columns = len(row)
+		}
+	}
+
+	sheet := image.NewRGBA(image.Rect(0, 0, columns*size, len(rows)*size))
+	for y, row := range rows {
+		ids := make([]string, len(row))
+		for x, record := range row {
+			thumbnail := pixelsToImage(aptToPixels(record.Tree, size, size), size, size)
+			draw.Draw(sheet, thumbnail.Bounds().Add(image.Pt(x*size, y*size)), thumbnail, image.Point{}, draw.Src)
+			ids[x] = record.ID
+		}
+		fmt.Printf("generation %d: %s\n", row[0].Generation, strings.Join(ids, " "))
+	}
+	return sheet
+}
+
+func statsCommand(args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the stats as JSON")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: evolving-pictures stats [flags] file.apt...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	type fileStats struct {
+		File string `json:"file"`
+		TreeStats
+		// the channels, to see which one makes a picture slow
+		Channels [3]TreeStats `json:"channels"`
+	}
+	var all []fileStats
+	for _, fileName := range flags.Args() {
+		p, err := loadPicture(fileName)
+		if err != nil {
+			return err
+		}
+		pict := NewOpPict()
+		pict.SetChildren([]Node{p.r, p.g, p.b})
+		all = append(all, fileStats{fileName, Stats(pict), [3]TreeStats{Stats(p.r), Stats(p.g), Stats(p.b)}})
+	}
+
+	if *asJSON {
+		data, err := json.MarshalIndent(all, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+	for _, f := range all {
+		fmt.Printf("%s: %d nodes, depth %d, cost %.0f, %.1f%% constant\n", f.File, f.Nodes, f.Depth, f.Cost, 100*f.ConstantShare)
+		for i, c := range f.Channels {
+			fmt.Printf("  %s: %d nodes, depth %d, cost %.0f, %.1f%% constant\n", channelPath(i, nil), c.Nodes, c.Depth, c.Cost, 100*c.ConstantShare)
+		}
+		names := make([]string, 0, len(f.Operators))
+		for name := range f.Operators {
+			names = append(names, name)
+		}
+		// the most used first
+		sort.Slice(names, func(i, j int) bool {
+			a, b := f.Operators[names[i]], f.Operators[names[j]]
+			return a > b || (a == b && names[i] < names[j])
+		})
+		counts := make([]string, len(names))
+		for i, name := range names {
+			counts[i] = fmt.Sprintf("%s %d", name, f.Operators[name])
+		}
+		fmt.Println("  " + strings.Join(counts, ", "))
+	}
+	return nil
+}
+
+func geneCommand(args []string) error {
+	flags := flag.NewFlagSet("gene", flag.ExitOnError)
+	name := flags.String("name", "", "name of the gene, by default the picture and path, like 3-r-0-1")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: evolving-pictures [-genes dir] gene [flags] file.apt path")
+		fmt.Fprintln(flags.Output(), "saves the subtree at path, like r/0/1 from the diff command, to the gene bank")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	fileName, pathName := flags.Arg(0), flags.Arg(1)
+	p, err := loadPicture(fileName)
+	if err != nil {
+		return err
+	}
+	channel, path, err := parseChannelPath(pathName)
+	if err != nil {
+		return err
+	}
+	node, ok := path.Find([]Node{p.r, p.g, p.b}[channel])
+	if !ok {
+		return fmt.Errorf("%s: no node at %s", fileName, pathName)
+	}
+	if *name == "" {
+		*name = strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName)) + "-" + strings.Replace(pathName, "/", "-", -1)
+	}
+	if strings.ContainsAny(*name, `/\`) {
+		return fmt.Errorf("gene name %q can't have slashes", *name)
+	}
+
+	if err := os.MkdirAll(*genesDir, 0755); err != nil {
+		return err
+	}
+	geneName := filepath.Join(*genesDir, *name+".apt")
+	if _, err := os.Stat(geneName); err == nil {
+		return fmt.Errorf("%s is already in the gene bank", *name)
+	}
+	return ioutil.WriteFile(geneName, []byte(Format(node, DefaultFormatOptions)), 0644)
+}
+
+func evolveCommand(args []string) error {
+	flags := flag.NewFlagSet("evolve", flag.ExitOnError)
+	cfg := gaConfig{}
+	flags.IntVar(&cfg.generations, "generations", 20, "number of generations, the first one random")
+	flags.IntVar(&cfg.population, "population", 24, "pictures in each generation")
+	flags.IntVar(&cfg.elite, "elite", 2, "the fittest pictures that go on to the next generation unchanged")
+	flags.StringVar(&cfg.selection, "selection", "tournament", `how parents are picked: "tournament", "truncation" from the fitter half, or "roulette" by fitness`)
+	flags.IntVar(&cfg.tournament, "tournament", 3, "pictures in each tournament")
+	flags.Float64Var(&cfg.mutation, "mutation", 0.3, "how likely a child is to be mutated too")
+	flags.IntVar(&cfg.size, "size", 64, "width and height pictures are judged at")
+	flags.IntVar(&cfg.keep, "keep", 1, "the fittest pictures written out at each checkpoint")
+	flags.IntVar(&cfg.checkpoint, "checkpoint", 1, "write out the fittest every this many generations, and after the last")
+	flags.IntVar(&cfg.pngSize, "png-size", 256, "width and height of the pngs written out")
+	flags.StringVar(&cfg.out, "o", "evolved", "directory to write the fittest pictures to")
+	fitness := flags.String("fitness", "entropy", "fitness functions to mix, with optional weights, like entropy:2,symmetry. Known ones are "+fitnessNames()+`, "mse" and "ssim" need -target`)
+	targetFile := flags.String("target", "", `image to evolve a likeness of, the fitness is "ssim" unless -fitness is given`)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: evolving-pictures evolve [flags]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	switch {
+	case cfg.generations < 1:
+		return fmt.Errorf("-generations must be at least 1")
+	case cfg.population < 2:
+		return fmt.Errorf("-population must be at least 2")
+	case cfg.elite < 0 || cfg.elite >= cfg.population:
+		return fmt.Errorf("-elite must be from 0 to less than -population")
+	case cfg.selection != "tournament" && cfg.selection != "truncation" && cfg.selection != "roulette":
+		return fmt.Errorf("unknown -selection %q, want tournament, truncation or roulette", cfg.selection)
+	case cfg.tournament < 1:
+		return fmt.Errorf("-tournament must be at least 1")
+	case cfg.size < 1 || cfg.pngSize < 1:
+		return fmt.Errorf("-size and -png-size must be at least 1")
+	case cfg.keep < 0 || cfg.keep > cfg.population:
+		return fmt.Errorf("-keep must be from 0 to -population")
+	case cfg.checkpoint < 1:
+		return fmt.Errorf("-checkpoint must be at least 1")
+	}
+	var target *image.RGBA
+	if *targetFile != "" {
+		var err error
+		if target, err = loadTarget(*targetFile, cfg.size); err != nil {
+			return err
+		}
+		fitnessSet := false
+		flags.Visit(func(f *flag.Flag) { fitnessSet = fitnessSet || f.Name == "fitness" })
+		if !fitnessSet {
+			*fitness = "ssim"
+		}
+	}
+	var err error
+	if cfg.fitness, err = parseFitness(*fitness, target); err != nil {
+		return err
+	}
+
+	hist, err := openHistory(*historyFile)
+	if err != nil {
+		return err
+	}
+	defer hist.Close()
+	return runEvolution(cfg, sessionRand(), hist)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// gaConfig are the settings of a headless evolution.
+type gaConfig struct {
+	generations int
+	population  int
+	// elite is how many of the fittest go on to the next generation as
+	// they are.
+	elite int
+	// selection picks the parents: tournament, truncation or roulette.
+	selection  string
+	tournament int
+	// mutation is how likely a child is to be mutated after the crossover.
+	mutation float64
+	// size is the width and height pictures are judged at.
+	size int
+	// keep is how many of the fittest are written out every checkpoint
+	// generations and after the last, at pngSize.
+	keep       int
+	checkpoint int
+	pngSize    int
+	out        string
+	fitness    func(img *image.RGBA) float64
+}
+
+// scoredPicture is a picture and its fitness.
+type scoredPicture struct {
+	p     *picture
+	score float64
+}
+
+// runEvolution breeds generations of pictures, fittest first, writing the
+// best of them to cfg.out as it goes.
+func runEvolution(cfg gaConfig, rng *rand.Rand, hist *history) error {
+	start := time.Now()
+	if err := os.MkdirAll(cfg.out, 0755); err != nil {
+		return err
+	}
+
+	population := make([]*picture, cfg.population)
+	for i := range population {
+		population[i] = withoutNonFinite(func() *picture { return newPicture(rng) })
+	}
+	if err := hist.add(population...); err != nil {
+		return err
+	}
+	var elite []scoredPicture
+	for gen := 0; gen < cfg.generations; gen++ {
+		// the elite were judged last generation
+		ranked := append(append([]scoredPicture(nil), elite...), scorePictures(population[len(elite):], cfg)...)
+		sort.SliceStable(ranked, func(i, j int) bool { return ranked[i].score > ranked[j].score })
+
+		mean := 0.0
+		for _, s := range ranked {
+			mean += s.score
+		}
+		mean /= float64(len(ranked))
+		fmt.Printf("generation %d: best %.4f mean %.4f %s %v\n", gen, ranked[0].score, mean, ranked[0].p.lineage.ID, time.Since(start).Round(time.Millisecond))
+		last := gen == cfg.generations-1
+		if gen%cfg.checkpoint == 0 || last {
+			if err := writeBest(ranked[:cfg.keep], gen, cfg, hist); err != nil {
+				return err
+			}
+		}
+		if last {
+			break
+		}
+
+		elite = ranked[:cfg.elite]
+		population = make([]*picture, 0, cfg.population)
+		for _, s := range elite {
+			population = append(population, s.p)
+		}
+		for len(population) < cfg.population {
+			a, b := selectParent(ranked, cfg, rng), selectParent(ranked, cfg, rng)
+			population = append(population, withoutNonFinite(func() *picture { return breed(a, b, cfg, rng) }))
+		}
+		if err := hist.add(population[cfg.elite:]...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// breed crosses a with b and now and then mutates the child.
+func breed(a, b *picture, cfg gaConfig, rng *rand.Rand) *picture {
+	child := cross(a, b, rng)
+	if rng.Float64() < cfg.mutation {
+		// the mutation is part of the same step as the crossover, so the
+		// child keeps the parents of the crossover
+		crossed := child.lineage
+		child.mutate(rng)
+		child.lineage.Parents = crossed.Parents
+		child.lineage.Generation = crossed.Generation
+		child.lineage.Operator = crossed.Operator + ", mutation"
+		child.lineage.Paths = append(crossed.Paths, child.lineage.Paths...)
+	}
+	return child
+}
+
+// scorePictures renders and judges pictures, on all the cores.
+func scorePictures(pictures []*picture, cfg gaConfig) []scoredPicture {
+	scored := make([]scoredPicture, len(pictures))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				img := pixelsToImage(aptToPixels(pictures[i], cfg.size, cfg.size), cfg.size, cfg.size)
+				scored[i] = scoredPicture{pictures[i], cfg.fitness(img)}
+			}
+		}()
+	}
+	for i := range pictures {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return scored
+}
+
+// selectParent picks a parent from ranked, which is sorted fittest first.
+func selectParent(ranked []scoredPicture, cfg gaConfig, rng *rand.Rand) *picture {
+	switch cfg.selection {
+	case "truncation":
+		// only the fitter half breeds
+		return ranked[rng.Intn((len(ranked)+1)/2)].p
+	case "roulette":
+		total := 0.0
+		for _, s := range ranked {
+			total += s.score
+		}
+		if total <= 0 {
+			return ranked[rng.Intn(len(ranked))].p
+		}
+		spin := rng.Float64() * total
+		for _, s := range ranked {
+			spin -= s.score
+			if spin < 0 {
+				return s.p
+			}
+		}
+		return ranked[len(ranked)-1].p
+	}
+	// tournament, the fittest of a few picked at random, and ranked is in
+	// order so that is the one with the lowest index
+	best := rng.Intn(len(ranked))
+	for i := 1; i < cfg.tournament; i++ {
+		if j := rng.Intn(len(ranked)); j < best {
+			best = j
+		}
+	}
+	return ranked[best].p
+}
+
+// writeBest writes the pictures as gen-0003-0.apt and .png in cfg.out, the
+// fittest numbered 0, and records them in the history.
+func writeBest(best []scoredPicture, gen int, cfg gaConfig, hist *history) error {
+	for i, s := range best {
+		name := filepath.Join(cfg.out, fmt.Sprintf("gen-%04d-%d", gen, i))
+		if err := ioutil.WriteFile(name+".apt", []byte(s.p.String()), 0644); err != nil {
+			return err
+		}
+		if err := hist.saved(s.p, name+".apt"); err != nil {
+			return err
+		}
+		pixels := aptToPixels(s.p, cfg.pngSize, cfg.pngSize)
+		if err := savePNG(name+".png", pixelsToImage(pixels, cfg.pngSize, cfg.pngSize)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
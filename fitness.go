@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// fitnessFuncs score a rendered picture for the evolve command, the higher
+// the fitter. They stay between 0 and 1 so they can be mixed.
+var fitnessFuncs = map[string]func(img *image.RGBA) float64{
+	"entropy":      entropyFitness,
+	"colorfulness": colorfulnessFitness,
+	"edges":        edgeFitness,
+	"complexity":   complexityFitness,
+	"symmetry":     symmetryFitness,
+}
+
+// targetFitnessFuncs score how close a rendered picture is to a target
+// picture of the same size, from 0 to 1 as well.
+var targetFitnessFuncs = map[string]func(img, target *image.RGBA) float64{
+	"mse":  mseFitness,
+	"ssim": ssimFitness,
+}
+
+func fitnessNames() string {
+	names := make([]string, 0, len(fitnessFuncs)+len(targetFitnessFuncs))
+	for name := range fitnessFuncs {
+		names = append(names, name)
+	}
+	for name := range targetFitnessFuncs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// parseFitness reads a comma separated list of fitness functions, each
+// optionally with a weight, like entropy:2,symmetry, into their weighted
+// mean. The ones that compare with a target need one, target is nil
+// otherwise.
+func parseFitness(spec string, target *image.RGBA) (func(img *image.RGBA) float64, error) {
+	var funcs []func(img *image.RGBA) float64
+	var weights []float64
+	total := 0.0
+	for _, part := range strings.Split(spec, ",") {
+		name, weight := part, 1.0
+		if i := strings.Index(part, ":"); i >= 0 {
+			w, err := strconv.ParseFloat(part[i+1:], 64)
+			if err != nil || w < 0 {
+				return nil, fmt.Errorf("bad weight in %q", part)
+			}
+			name, weight = part[:i], w
+		}
+		f, ok := fitnessFuncs[name]
+		if tf, isTarget := targetFitnessFuncs[name]; isTarget {
+			if target == nil {
+				return nil, fmt.Errorf("fitness %q needs a -target", name)
+			}
+			f, ok = func(img *image.RGBA) float64 { return tf(img, target) }, true
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown fitness %q, known ones are %s", name, fitnessNames())
+		}
+		funcs = append(funcs, f)
+		weights = append(weights, weight)
+		total += weight
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("fitness %q has no weight", spec)
+	}
+	return func(img *image.RGBA) float64 {
+		score := 0.0
+		for i, f := range funcs {
+			if weights[i] != 0 {
+				score += weights[i] * f(img)
+			}
+		}
+		return score / total
+	}, nil
+}
+
+// luminance returns the brightness of every pixel, from 0 to 255.
+func luminance(img *image.RGBA) []float64 {
+	lum := make([]float64, len(img.Pix)/4)
+	for i := range lum {
+		p := img.Pix[i*4 : i*4+3]
+		lum[i] = 0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])
+	}
+	return lum
+}
+
+// entropyFitness is the Shannon entropy of the brightness, in bits out of
+// the 8 a perfectly even spread would have.
+func entropyFitness(img *image.RGBA) float64 {
+	var histogram [256]int
+	lum := luminance(img)
+	for _, l := range lum {
+		histogram[int(l+0.5)]++
+	}
+	entropy := 0.0
+	for _, count := range histogram {
+		if count > 0 {
+			p := float64(count) / float64(len(lum))
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy / 8
+}
+
+// colorfulnessFitness is the colorfulness of Hasler and Suesstrunk, which
+// goes up with how saturated and varied the colors are. Above 150 is
+// extremely colorful, and counts as 1.
+func colorfulnessFitness(img *image.RGBA) float64 {
+	var sumRG, sumYB, sumRG2, sumYB2 float64
+	n := float64(len(img.Pix) / 4)
+	for i := 0; i < len(img.Pix); i += 4 {
+		r, g, b := float64(img.Pix[i]), float64(img.Pix[i+1]), float64(img.Pix[i+2])
+		rg, yb := r-g, (r+g)/2-b
+		sumRG, sumYB = sumRG+rg, sumYB+yb
+		sumRG2, sumYB2 = sumRG2+rg*rg, sumYB2+yb*yb
+	}
+	meanRG, meanYB := sumRG/n, sumYB/n
+	varRG, varYB := sumRG2/n-meanRG*meanRG, sumYB2/n-meanYB*meanYB
+	c := math.Sqrt(math.Max(varRG+varYB, 0)) + 0.3*math.Sqrt(meanRG*meanRG+meanYB*meanYB)
+	return math.Min(c/150, 1)
+}
+
+// edgeThreshold is how steep the Sobel gradient of the brightness has to be
+// for a pixel to count as an edge.
+const edgeThreshold = 64
+
+// edgeFitness is the share of the pixels that are on an edge.
+func edgeFitness(img *image.RGBA) float64 {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	if w < 3 || h < 3 {
+		return 0
+	}
+	lum := luminance(img)
+	at := func(x, y int) float64 { return lum[y*w+x] }
+	edges := 0
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			gx := at(x+1, y-1) + 2*at(x+1, y) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x-1, y) - at(x-1, y+1)
+			gy := at(x-1, y+1) + 2*at(x, y+1) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x, y-1) - at(x+1, y-1)
+			if math.Hypot(gx, gy) > edgeThreshold {
+				edges++
+			}
+		}
+	}
+	return float64(edges) / float64((w-2)*(h-2))
+}
+
+// complexityFitness is how badly the colors compress, the compressed size
+// over the raw size. Flat pictures compress to almost nothing, noise hardly
+// at all.
+func complexityFitness(img *image.RGBA) float64 {
+	raw := make([]byte, 0, len(img.Pix)/4*3)
+	for i := 0; i < len(img.Pix); i += 4 {
+		raw = append(raw, img.Pix[i:i+3]...)
+	}
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	w.Write(raw)
+	w.Close()
+	return math.Min(float64(buf.Len())/float64(len(raw)), 1)
+}
+
+// symmetryFitness is how alike the picture is to its mirror image, left to
+// right or top to bottom, whichever is closer.
+func symmetryFitness(img *image.RGBA) float64 {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	var leftRight, topBottom float64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := img.Pix[(y*w+x)*4:]
+			lr := img.Pix[(y*w+w-1-x)*4:]
+			tb := img.Pix[((h-1-y)*w+x)*4:]
+			for c := 0; c < 3; c++ {
+				leftRight += math.Abs(float64(p[c]) - float64(lr[c]))
+				topBottom += math.Abs(float64(p[c]) - float64(tb[c]))
+			}
+		}
+	}
+	diff := math.Min(leftRight, topBottom) / float64(w*h*3) / 255
+	return 1 - diff
+}
+
+// loadTarget reads the picture in fileName and scales it to size by size,
+// averaging the pixels that fall in each one, so it can be compared with
+// pictures judged at that size.
+func loadTarget(fileName string, size int) (*image.RGBA, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+
+	b := src.Bounds()
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/size, b.Min.Y+(y+1)*b.Dy()/size
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < size; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/size, b.Min.X+(x+1)*b.Dx()/size
+			if x1 == x0 {
+				x1++
+			}
+			var r, g, bl, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := color.RGBAModel.Convert(src.At(sx, sy)).(color.RGBA)
+					r, g, bl, n = r+uint32(c.R), g+uint32(c.G), bl+uint32(c.B), n+1
+				}
+			}
+			img.SetRGBA(x, y, color.RGBA{uint8(r / n), uint8(g / n), uint8(bl / n), 255})
+		}
+	}
+	return img, nil
+}
+
+// mseFitness is one minus the mean squared error of the colors, over the
+// largest one there can be.
+func mseFitness(img, target *image.RGBA) float64 {
+	sum := 0.0
+	for i := 0; i < len(img.Pix); i += 4 {
+		for c := 0; c < 3; c++ {
+			d := float64(img.Pix[i+c]) - float64(target.Pix[i+c])
+			sum += d * d
+		}
+	}
+	return 1 - sum/float64(len(img.Pix)/4*3)/(255*255)
+}
+
+// ssimWindow is the width and height of the windows SSIM is measured over,
+// they overlap by half.
+const ssimWindow = 8
+
+// ssimFitness is the structural similarity of Wang et al. of each color,
+// averaged over windows and colors. It looks at the local brightness,
+// contrast and structure rather than exact colors, so it favors pictures
+// with the same shapes. SSIM goes from -1 to 1, the fitness from 0 to 1.
+func ssimFitness(img, target *image.RGBA) float64 {
+	const c1, c2 = (0.01 * 255) * (0.01 * 255), (0.03 * 255) * (0.03 * 255)
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	win := ssimWindow
+	if w < win || h < win {
+		win = w
+		if h < win {
+			win = h
+		}
+	}
+	sum, windows := 0.0, 0
+	for y := 0; y+win <= h; y += (win + 1) / 2 {
+		for x := 0; x+win <= w; x += (win + 1) / 2 {
+			for c := 0; c < 3; c++ {
+				var sa, sb, saa, sbb, sab float64
+				for wy := y; wy < y+win; wy++ {
+					for wx := x; wx < x+win; wx++ {
+						i := (wy*w+wx)*4 + c
+						a, b := float64(img.Pix[i]), float64(target.Pix[i])
+						sa, sb = sa+a, sb+b
+						saa, sbb, sab = saa+a*a, sbb+b*b, sab+a*b
+					}
+				}
+				n := float64(win * win)
+				ma, mb := sa/n, sb/n
+				va, vb, cov := saa/n-ma*ma, sbb/n-mb*mb, sab/n-ma*mb
+				sum += (2*ma*mb + c1) * (2*cov + c2) / ((ma*ma + mb*mb + c1) * (va + vb + c2))
+				windows++
+			}
+		}
+	}
+	return (sum/float64(windows) + 1) / 2
+}
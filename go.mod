@@ -3,6 +3,6 @@ module github.com/ahmadfarhanstwn/evolving-pictures
 go 1.17
 
 require (
-	github.com/ahmadfarhanstwn/noise v0.0.0-20220415142742-de76a332a661 // indirect
-	github.com/veandco/go-sdl2 v0.4.20 // indirect
+	github.com/ahmadfarhanstwn/noise v0.0.0-20220415142742-de76a332a661
+	github.com/veandco/go-sdl2 v0.4.20
 )
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/ahmadfarhanstwn/evolving-pictures/apt"
+)
+
+var historyFile = flag.String("history", "history.jsonl", "append every picture made, and who it was bred from, to this file, empty to keep no history")
+
+// lineage is where a picture came from.
+type lineage struct {
+	ID         string `json:"id"`
+	Generation int    `json:"generation"`
+	// Parents are the IDs of the pictures this one was bred from, for a
+	// crossover the one that was copied first.
+	Parents []string `json:"parents,omitempty"`
+	// Operator made the picture: random, crossover, mutation or gene.
+	Operator string `json:"operator"`
+	// Paths are the nodes the operator worked on, like g/0/1. For a
+	// crossover the node of the first parent that was replaced, then the
+	// node of the second parent that replaced it, and for a gene the node
+	// that was replaced, then the name of the gene.
+	Paths []string `json:"paths,omitempty"`
+}
+
+// session starts the IDs of the pictures made by this run, so they don't
+// clash with those from earlier runs in the same history.
+var session = strconv.FormatInt(time.Now().UnixNano(), 36)
+var lastID int
+
+func newID() string {
+	lastID++
+	return session + "-" + strconv.Itoa(lastID)
+}
+
+func randomLineage() lineage {
+	return lineage{ID: newID(), Operator: "random"}
+}
+
+// bredLineage is the lineage of a child of parents made by operator.
+func bredLineage(operator string, paths []string, parents ...*picture) lineage {
+	l := lineage{ID: newID(), Operator: operator, Paths: paths}
+	for _, p := range parents {
+		l.Parents = append(l.Parents, p.lineage.ID)
+		if p.lineage.Generation+1 > l.Generation {
+			l.Generation = p.lineage.Generation + 1
+		}
+	}
+	return l
+}
+
+// channelPath writes the path to a node of channel, r, g or b, like r/0/1.
+func channelPath(channel int, path Path) string {
+	s := "rgb"[channel : channel+1]
+	if len(path) == 0 {
+		return s
+	}
+	return s + path.String()
+}
+
+// parseChannelPath reads a path written by channelPath.
+func parseChannelPath(s string) (int, Path, error) {
+	parts := strings.Split(s, "/")
+	channel := strings.Index("rgb", parts[0])
+	if len(parts[0]) != 1 || channel < 0 {
+		return 0, nil, fmt.Errorf("path %q doesn't start with r, g or b", s)
+	}
+	var path Path
+	for _, part := range parts[1:] {
+		i, err := strconv.Atoi(part)
+		if err != nil || i < 0 {
+			return 0, nil, fmt.Errorf("path %q has %q for a child", s, part)
+		}
+		path = append(path, i)
+	}
+	return channel, path, nil
+}
+
+// nthPath returns the path to the node GetNthChildren finds for n, counting
+// the nodes in the same order.
+func nthPath(node Node, n int) Path {
+	var path Path
+	for n > 0 {
+		n--
+		for i, child := range node.GetChildren() {
+			size := child.CountNode()
+			if n < size {
+				path = append(path, i)
+				node = child
+				break
+			}
+			n -= size
+		}
+	}
+	return path
+}
+
+// historyRecord is a line of the history file. It is either a new picture,
+// with its tree, or a picture that was saved to File.
+type historyRecord struct {
+	lineage
+	Tree *picture `json:"tree,omitempty"`
+	File string   `json:"file,omitempty"`
+}
+
+type history struct {
+	file *os.File
+	enc  *json.Encoder
+}
+
+// openHistory opens the history file for appending. A nil history, for no
+// file name, keeps nothing.
+func openHistory(fileName string) (*history, error) {
+	if fileName == "" {
+		return nil, nil
+	}
+	file, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &history{file, json.NewEncoder(file)}, nil
+}
+
+// add records pictures that were just made.
+func (h *history) add(pictures ...*picture) error {
+	if h == nil {
+		return nil
+	}
+	for _, p := range pictures {
+		if err := h.enc.Encode(historyRecord{lineage: p.lineage, Tree: p}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saved records that p was saved to fileName.
+func (h *history) saved(p *picture, fileName string) error {
+	if h == nil || p.lineage.ID == "" {
+		return nil
+	}
+	return h.enc.Encode(struct {
+		ID   string `json:"id"`
+		File string `json:"file"`
+	}{p.lineage.ID, fileName})
+}
+
+func (h *history) Close() error {
+	if h == nil {
+		return nil
+	}
+	return h.file.Close()
+}
+
+// readHistory returns the pictures in a history file by ID, and the ID of the
+// picture last saved to each file.
+func readHistory(fileName string) (map[string]historyRecord, map[string]string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	records, files := map[string]historyRecord{}, map[string]string{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record historyRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: %v", fileName, line, err)
+		}
+		if record.File != "" {
+			files[filepath.Clean(record.File)] = record.ID
+		} else {
+			records[record.ID] = record
+		}
+	}
+	return records, files, scanner.Err()
+}
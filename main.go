@@ -1,10 +1,16 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -16,6 +22,14 @@ import (
 
 var winWidth, winHeight, rows, columns, numPics int = 800, 600, 3, 3, rows*columns
 
+var simplifyOnSave = flag.Bool("simplify", false, "simplify pictures before saving them")
+var animate = flag.Bool("animate", false, "let new pictures and mutations use the time t")
+var imageDir = flag.String("images", "", "load the png and jpeg images in this directory for image nodes to sample")
+var wrapImages = flag.Bool("wrap-images", false, "tile images instead of repeating their edges")
+var seed = flag.Int64("seed", 0, "seed for generating and evolving pictures, 0 picks one from the clock")
+var genesDir = flag.String("genes", "genes", "directory of the gene bank, subtrees saved with the gene command to reuse in new pictures")
+var geneRate = flag.Float64("gene-rate", GeneProbability, "how likely new pictures, mutations and crossovers are to take a gene from the bank")
+
 type audioState struct {
 	explosionBytes []byte
 	deviceID       sdl.AudioDeviceID
@@ -39,13 +53,19 @@ type guiState struct {
 
 type picture struct {
 	r, g, b Node
+	lineage lineage
 }
 
 func (p *picture) String() string {
 	return "( picture\n" + p.r.String() + "\n" + p.g.String() + "\n" + p.b.String() + ")"
 }
 
-func saveTree(p *picture) {
+// saveTree writes p to the next free N.apt and returns its name.
+func saveTree(p *picture, simplify bool) string {
+	if simplify {
+		p = &picture{Simplify(p.r), Simplify(p.g), Simplify(p.b), p.lineage}
+	}
+
 	files, err := ioutil.ReadDir("./")
 	if err != nil {
 		panic(err)
@@ -72,12 +92,148 @@ func saveTree(p *picture) {
 	}
 	defer file.Close()
 	fmt.Fprintf(file, p.String())
+	return savedFile
+}
+
+// MarshalJSON writes the picture as the JSON of its ( picture r g b ) tree.
+func (p *picture) MarshalJSON() ([]byte, error) {
+	pict := NewOpPict()
+	pict.SetChildren([]Node{p.r, p.g, p.b})
+	return json.Marshal(Tree{Node: pict})
+}
+
+func (p *picture) UnmarshalJSON(data []byte) error {
+	var t Tree
+	if err := json.Unmarshal(data, &t); err != nil {
+		return err
+	}
+	if _, ok := t.Node.(*OpPict); !ok {
+		return fmt.Errorf("expected a ( picture r g b ) tree")
+	}
+	p.r, p.g, p.b = t.Node.GetChildren()[0], t.Node.GetChildren()[1], t.Node.GetChildren()[2]
+	return nil
+}
+
+// loadPicture reads a picture written out as text, or as JSON if the file
+// name ends in .json, and checks it can be drawn.
+func loadPicture(fileName string) (*picture, error) {
+	p, err := readPicture(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, _, err := p.compile(Strict); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	return p, nil
+}
+
+func readPicture(fileName string) (*picture, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if strings.EqualFold(filepath.Ext(fileName), ".json") {
+		p := &picture{}
+		if err := json.NewDecoder(file).Decode(p); err != nil {
+			return nil, fmt.Errorf("%s: %v", fileName, err)
+		}
+		return p, nil
+	}
+
+	node, err := Parse(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%v", fileName, err)
+	}
+	if _, ok := node.(*OpPict); !ok {
+		return nil, fmt.Errorf("%s: expected a ( picture r g b ) tree", fileName)
+	}
+	return &picture{node.GetChildren()[0], node.GetChildren()[1], node.GetChildren()[2], lineage{}}, nil
+}
+
+// loadImages registers every png and jpeg in dir under its file name without
+// the extension, so photo.jpg can be sampled by ( image "photo" u v ).
+func loadImages(dir string, wrap bool) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	mode := EdgeClamp
+	if wrap {
+		mode = EdgeWrap
+	}
+	for _, file := range files {
+		ext := strings.ToLower(filepath.Ext(file.Name()))
+		if ext != ".png" && ext != ".jpg" && ext != ".jpeg" {
+			continue
+		}
+		f, err := os.Open(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return err
+		}
+		img, _, err := image.Decode(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", file.Name(), err)
+		}
+		RegisterImage(strings.TrimSuffix(file.Name(), filepath.Ext(file.Name())), img, mode)
+	}
+	return nil
+}
+
+// loadGenes adds every .apt file in dir to the gene bank, under its file name
+// without the extension. There is no bank until something is saved to it, so
+// a missing dir is fine.
+func loadGenes(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".apt" {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return err
+		}
+		node, err := Parse(strings.NewReader(string(data)))
+		if err != nil {
+			return fmt.Errorf("%s:%v", file.Name(), err)
+		}
+		if _, err := Compile(node); err != nil {
+			return fmt.Errorf("%s: %v", file.Name(), err)
+		}
+		RegisterGene(strings.TrimSuffix(file.Name(), ".apt"), node)
+	}
+	return nil
 }
 
-func (p *picture) mutate() {
-	r := rand.Intn(3)
+// graft puts node in the place of old, a node of channel.
+func (p *picture) graft(channel int, old, node Node) {
+	root := old.GetParent() == nil
+	ReplaceNode(old, node)
+	if !root {
+		return
+	}
+	switch channel {
+	case 0:
+		p.r = node
+	case 1:
+		p.g = node
+	case 2:
+		p.b = node
+	}
+}
+
+func (p *picture) mutate(rng *rand.Rand) {
 	var mutateNode Node
-	switch r {
+	channel := rng.Intn(3)
+	switch channel {
 	case 0:
 		mutateNode = p.r
 	case 1:
@@ -87,9 +243,10 @@ func (p *picture) mutate() {
 	}
 
 	count := mutateNode.CountNode()
-	r = rand.Intn(count)
-	mutateNode, count = GetNthChildren(mutateNode, r, 0)
-	mutation := Mutate(mutateNode)
+	n := rng.Intn(count)
+	path := channelPath(channel, nthPath(mutateNode, n))
+	mutateNode, count = GetNthChildren(mutateNode, n, 0)
+	mutation := Mutate(mutateNode, rng)
 	if mutateNode == p.r {
 		p.r = mutation
 	} else if mutateNode == p.g {
@@ -97,91 +254,120 @@ func (p *picture) mutate() {
 	} else if mutateNode == p.b {
 		p.b = mutation
 	}
+	p.lineage = bredLineage("mutation", []string{path}, p)
 }
 
-func (p *picture) pickRandomColor() Node {
-	r := rand.Intn(3)
-	switch r {
+// pickRandomColor returns one of the channels and its number, 0 for red.
+func (p *picture) pickRandomColor(rng *rand.Rand) (Node, int) {
+	switch channel := rng.Intn(3); channel {
 	case 0:
-		return p.r
+		return p.r, channel
 	case 1:
-		return p.g
+		return p.g, channel
 	case 2:
-		return p.b
+		return p.b, channel
 	default:
 		panic("random out of the bounds")
 	}
 }
 
-func cross(a, b *picture) *picture {
-	aCopy := &picture{CopyTree(a.r, nil), CopyTree(a.g, nil), CopyTree(a.b,nil)}
-	aColor := aCopy.pickRandomColor()
-	bColor := b.pickRandomColor()
+func cross(a, b *picture, rng *rand.Rand) *picture {
+	aCopy := &picture{CopyTree(a.r, nil), CopyTree(a.g, nil), CopyTree(a.b,nil), lineage{}}
+	aColor, aChannel := aCopy.pickRandomColor(rng)
+	bColor, bChannel := b.pickRandomColor(rng)
 
-	aIndex := rand.Intn(aColor.CountNode())
+	aIndex := rng.Intn(aColor.CountNode())
 	aNode, _ := GetNthChildren(aColor, aIndex, 0)
 
-	bIndex := rand.Intn(bColor.CountNode())
+	aPath := channelPath(aChannel, nthPath(aColor, aIndex))
+	if name, gene := RandomGene(rng); gene != nil {
+		aCopy.graft(aChannel, aNode, gene)
+		aCopy.lineage = bredLineage("gene", []string{aPath, name}, a)
+		return aCopy
+	}
+
+	bIndex := rng.Intn(bColor.CountNode())
 	bNode, _ := GetNthChildren(bColor, bIndex, 0)
 	bNodeCopy := CopyTree(bNode, bNode.GetParent())
 
-	ReplaceNode(aNode, bNodeCopy)
+	paths := []string{aPath, channelPath(bChannel, nthPath(bColor, bIndex))}
+	aCopy.graft(aChannel, aNode, bNodeCopy)
+	aCopy.lineage = bredLineage("crossover", paths, a, b)
 	return aCopy
 }
 
-func evolve(survivor []*picture) []*picture {
+func evolve(survivor []*picture, rng *rand.Rand) []*picture {
 	newPics := make([]*picture, numPics)
 	i := 0
 	for i < len(survivor) {
 		a := survivor[i]
-		b := survivor[rand.Intn(len(survivor))]
-		newPics[i] = cross(a,b)
+		b := survivor[rng.Intn(len(survivor))]
+		newPics[i] = withoutNonFinite(func() *picture { return cross(a, b, rng) })
 		i++
 	}
 
 	for i < len(newPics) {
-		a := survivor[rand.Intn(len(survivor))]
-		b := survivor[rand.Intn(len(survivor))]
-		newPics[i] = cross(a,b)
+		a := survivor[rng.Intn(len(survivor))]
+		b := survivor[rng.Intn(len(survivor))]
+		newPics[i] = withoutNonFinite(func() *picture { return cross(a, b, rng) })
 		i++
 	}
 
 	return newPics
 }
 
-func newPicture() *picture {
+func newPicture(rng *rand.Rand) *picture {
 	p := &picture{}
 
-	p.r = GetRandomNodeOpt()
-	p.g = GetRandomNodeOpt()
-	p.b = GetRandomNodeOpt()
+	p.r = GetRandomNodeOpt(rng)
+	p.g = GetRandomNodeOpt(rng)
+	p.b = GetRandomNodeOpt(rng)
+	p.lineage = randomLineage()
 
 	//operation type
-	r := rand.Intn(20) + 10
+	r := rng.Intn(20) + 10
 	for i := 0; i < r; i++ {
-		p.r.AddRandom(GetRandomNodeOpt())
+		p.r.AddRandom(GetRandomNodeOpt(rng), rng)
 	}
 
-	r = rand.Intn(20) + 10
+	r = rng.Intn(20) + 10
 	for i := 0; i < r; i++ {
-		p.g.AddRandom(GetRandomNodeOpt())
+		p.g.AddRandom(GetRandomNodeOpt(rng), rng)
 	}
 
-	r = rand.Intn(20) + 10
+	r = rng.Intn(20) + 10
 	for i := 0; i < r; i++ {
-		p.b.AddRandom(GetRandomNodeOpt())
+		p.b.AddRandom(GetRandomNodeOpt(rng), rng)
 	}
 
 	//leaf node
-	for p.r.AddLeaf(GetRandomLeafNode()){}
+	for p.r.AddLeaf(GetRandomLeafNode(rng)){}
+
+	for p.g.AddLeaf(GetRandomLeafNode(rng)){}
 
-	for p.g.AddLeaf(GetRandomLeafNode()){}
+	for p.b.AddLeaf(GetRandomLeafNode(rng)){}
 
-	for p.b.AddLeaf(GetRandomLeafNode()){}
+	// maybe start each channel off with a gene somewhere in it
+	for channel, root := range []Node{p.r, p.g, p.b} {
+		if _, gene := RandomGene(rng); gene != nil {
+			old, _ := GetNthChildren(root, rng.Intn(root.CountNode()), 0)
+			p.graft(channel, old, gene)
+		}
+	}
 
 	return p
 }
 
+// sessionRand returns the source of everything random in a session. Running
+// again with the seed it prints gives the same pictures for the same clicks.
+func sessionRand() *rand.Rand {
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	fmt.Println("seed:", *seed)
+	return rand.New(rand.NewSource(*seed))
+}
+
 func clear(pixels []byte) {
 	for i := range pixels {
 		pixels[i] = 0
@@ -207,25 +393,54 @@ func pixelsToTexture(renderer *sdl.Renderer, pixels []byte, w, h int) *sdl.Textu
 }
 
 func aptToPixels(p *picture, w, h int) []byte {
-	scale := float32(255/2)
-	offset := float32(-1.0*scale)
-	pixels := make([]byte, w*h*4)
-	pixelIndex := 0
+	return aptToPixelsAt(p, w, h, 0)
+}
+
+// compile compiles each channel of p to follow policy.
+func (p *picture) compile(policy NumericPolicy) (r, g, b *Program, err error) {
+	if r, err = CompileWith(p.r, policy); err != nil {
+		return nil, nil, nil, err
+	}
+	if g, err = CompileWith(p.g, policy); err != nil {
+		return nil, nil, nil, err
+	}
+	if b, err = CompileWith(p.b, policy); err != nil {
+		return nil, nil, nil, err
+	}
+	return r, g, b, nil
+}
+
+// aptToPixelsAt renders the frame of an animated picture at time t.
+func aptToPixelsAt(p *picture, w, h int, t float32) []byte {
+	r, g, b, err := p.compile(numericPolicy())
+	if err != nil {
+		panic(err)
+	}
+	xs := make([]float32, w)
+	for xi := range xs {
+		xs[xi] = float32(xi)/float32(w)*2-1
+	}
+	rValues, gValues, bValues := make([]float32, w*h), make([]float32, w*h), make([]float32, w*h)
 	for yi := 0; yi < h; yi++ {
 		y := float32(yi)/float32(h)*2-1
-		for xi := 0; xi < w; xi++ {
-			x := float32(xi)/float32(w)*2-1
-			c := p.r.Eval(x,y)
-			c2 := p.g.Eval(x,y)
-			c3 := p.b.Eval(x,y)
-			pixels[pixelIndex] = byte(c*scale-offset)
-			pixelIndex++
-			pixels[pixelIndex] = byte(c2*scale-offset)
-			pixelIndex++
-			pixels[pixelIndex] = byte(c3*scale-offset)
-			pixelIndex++
-			pixelIndex++
-		}
+		r.EvalRowAt(xs, y, t, rValues[yi*w:(yi+1)*w])
+		g.EvalRowAt(xs, y, t, gValues[yi*w:(yi+1)*w])
+		b.EvalRowAt(xs, y, t, bValues[yi*w:(yi+1)*w])
+	}
+
+	rMap := newChannelMap(p.r, rValues, t)
+	gMap := newChannelMap(p.g, gValues, t)
+	bMap := newChannelMap(p.b, bValues, t)
+	pixels := make([]byte, w*h*4)
+	pixelIndex := 0
+	for i := range rValues {
+		pixels[pixelIndex] = rMap.byte(rValues[i])
+		pixelIndex++
+		pixels[pixelIndex] = gMap.byte(gValues[i])
+		pixelIndex++
+		pixels[pixelIndex] = bMap.byte(bValues[i])
+		pixelIndex++
+		pixelIndex++
 	}
 	return pixels
 }
@@ -240,27 +455,7 @@ func pixelsToTextureChan(renderer *sdl.Renderer, pixels []byte, w, h int, textur
 }
 
 func aptToPixelsChan(p *picture, w, h int, pixelChan chan []byte) {
-	scale := float32(255/2)
-	offset := float32(-1.0*scale)
-	pixels := make([]byte, w*h*4)
-	pixelIndex := 0
-	for yi := 0; yi < h; yi++ {
-		y := float32(yi)/float32(h)*2-1
-		for xi := 0; xi < w; xi++ {
-			x := float32(xi)/float32(w)*2-1
-			c := p.r.Eval(x,y)
-			c2 := p.g.Eval(x,y)
-			c3 := p.b.Eval(x,y)
-			pixels[pixelIndex] = byte(c*scale-offset)
-			pixelIndex++
-			pixels[pixelIndex] = byte(c2*scale-offset)
-			pixelIndex++
-			pixels[pixelIndex] = byte(c3*scale-offset)
-			pixelIndex++
-			pixelIndex++
-		}
-	}
-	pixelChan <- pixels
+	pixelChan <- aptToPixels(p, w, h)
 }
 
 func lerp(b1 byte, b2 byte, pct float32) byte {
@@ -318,6 +513,42 @@ func rescaleAndDraw(noise []float32, min, max float32, gradient []rgba, w, h int
 }
 
 func main() {
+	flag.Parse()
+	Animated = *animate
+	if err := checkRenderFlags(); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if *imageDir != "" {
+		if err := loadImages(*imageDir, *wrapImages); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	GeneProbability = *geneRate
+	if err := loadGenes(*genesDir); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	var loaded *picture
+	args := flag.Args()
+	if len(args) > 0 {
+		if command, ok := commands[args[0]]; ok {
+			if err := command(args[1:]); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			return
+		}
+		p, err := loadPicture(args[0])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		loaded = p
+	}
+
 	sdl.LogSetAllPriority(sdl.LOG_PRIORITY_VERBOSE)
 	err := sdl.Init(sdl.INIT_EVERYTHING)
 	if err != nil {
@@ -361,11 +592,21 @@ func main() {
 		prevKeyboardState[i] = v
 	}
 
-	rand.Seed(time.Now().UnixNano())
+	rng := sessionRand()
+
+	hist, err := openHistory(*historyFile)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer hist.Close()
 
 	picturesTree := make([]*picture, numPics)
 	for i := range picturesTree {
-		picturesTree[i] = newPicture()
+		picturesTree[i] = withoutNonFinite(func() *picture { return newPicture(rng) })
+	}
+	if err := hist.add(picturesTree...); err != nil {
+		fmt.Println(err)
 	}
 
 	picWidth := int(float32(winWidth/columns)*float32(.9))
@@ -380,15 +621,8 @@ func main() {
 
 	zoomState := guiState{false, nil, nil}
 
-	args := os.Args
-	if len(args) > 1 {
-		fileBytes, err := ioutil.ReadFile(args[1])
-		if err != nil {
-			panic(err)
-		}
-		fileStr := string(fileBytes)
-		pictureNode := BeginLexing(fileStr)
-		p := &picture{pictureNode.GetChildren()[0], pictureNode.GetChildren()[1], pictureNode.GetChildren()[2]}
+	if loaded != nil {
+		p := loaded
 		pixels := aptToPixels(p, winWidth*2, winHeight*2)
 		tex := pixelsToTexture(renderer, pixels, winWidth*2, winHeight*2)
 		zoomState.zoom = true
@@ -485,7 +719,10 @@ func main() {
 					for i := range buttons {
 						buttons[i] = nil
 					}
-					picturesTree = evolve(selectedPicture)
+					picturesTree = evolve(selectedPicture, rng)
+					if err := hist.add(picturesTree...); err != nil {
+						fmt.Println(err)
+					}
 					for i := range picturesTree {
 						go func(j int) {
 							pixels := aptToPixels(picturesTree[j], picWidth*2, picHeight*2)
@@ -500,7 +737,10 @@ func main() {
 				zoomState.zoom = false
 			}
 			if keyboardState[sdl.SCANCODE_S] == 0 && prevKeyboardState[sdl.SCANCODE_S] != 0 {
-				saveTree(zoomState.zoomTree)
+				savedFile := saveTree(zoomState.zoomTree, *simplifyOnSave)
+				if err := hist.saved(zoomState.zoomTree, savedFile); err != nil {
+					fmt.Println(err)
+				}
 			}
 			renderer.Copy(zoomState.zoomPicture, nil,nil)
 		}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	. "github.com/ahmadfarhanstwn/evolving-pictures/apt"
+)
+
+func TestPictureJSON(t *testing.T) {
+	var channels [3]Node
+	for i, src := range []string{"( + x ( sin y ) )", "( fbm x y 2 0.5 2 4 )", "( worleyf1 7 x ( * y -0.25 ) )"} {
+		node, err := Parse(strings.NewReader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		channels[i] = node
+	}
+	p := &picture{r: channels[0], g: channels[1], b: channels[2]}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tree Tree
+	if err := json.Unmarshal(data, &tree); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tree.Node.(*OpPict); !ok {
+		t.Fatalf("written as %s, not a ( picture r g b ) tree", tree.Node)
+	}
+
+	var read picture
+	if err := json.Unmarshal(data, &read); err != nil {
+		t.Fatal(err)
+	}
+	if read.String() != p.String() {
+		t.Fatalf("reads back as\n%s\nnot\n%s", read.String(), p.String())
+	}
+
+	if err := json.Unmarshal([]byte(`{"version": 1, "tree": {"op": "x"}}`), &read); err == nil {
+		t.Fatal("read a tree that isn't a picture")
+	}
+}
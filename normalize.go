@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+
+	. "github.com/ahmadfarhanstwn/evolving-pictures/apt"
+)
+
+var normalize = flag.String("normalize", "", `rescale each channel to 0..255 from its "range", found by analyzing the tree, or from the min and max of a "sample" render`)
+var mapping = flag.String("mapping", "wrap", `what happens to values outside 0..255: "clamp", "wrap" or "sigmoid"`)
+var numeric = flag.String("numeric", "strict", `"strict" renders NaN and Inf like Eval gives them, "safe" divides by zero to 0, turns NaN into 0 and saturates overflows as it goes. Only rendering, which compiles the trees, follows it: Eval, export-glsl and export-go stay strict`)
+var maxNonFinite = flag.Float64("max-nonfinite", 5, "drop new pictures with more than this percentage of NaN or Inf pixels under the strict policy from a generation, and make others, 100 turns this off")
+
+// checkRenderFlags reports a bad -normalize or -mapping before anything is
+// rendered.
+func checkRenderFlags() error {
+	switch *normalize {
+	case "", "range", "sample":
+	default:
+		return fmt.Errorf("unknown -normalize %q, want range or sample", *normalize)
+	}
+	switch *mapping {
+	case "clamp", "wrap", "sigmoid":
+	default:
+		return fmt.Errorf("unknown -mapping %q, want clamp, wrap or sigmoid", *mapping)
+	}
+	if _, err := ParseNumericPolicy(*numeric); err != nil {
+		return fmt.Errorf("-numeric: %v", err)
+	}
+	return nil
+}
+
+// numericPolicy is the policy -numeric asks for, checked by
+// checkRenderFlags.
+func numericPolicy() NumericPolicy {
+	policy, _ := ParseNumericPolicy(*numeric)
+	return policy
+}
+
+// nonFiniteSize is the width and height of the grid pictures are checked
+// for NaN and Inf on.
+const nonFiniteSize = 32
+
+// tooNonFinite reports whether more of p than -max-nonfinite allows is NaN
+// or Inf. Pictures that can't be compiled can't be drawn either, so they
+// count as too non-finite.
+func tooNonFinite(p *picture) bool {
+	if *maxNonFinite >= 100 {
+		return false
+	}
+	share, err := NonFiniteShare([]Node{p.r, p.g, p.b}, nonFiniteSize, 0)
+	return err != nil || 100*share > *maxNonFinite
+}
+
+// withoutNonFinite makes pictures until one isn't tooNonFinite, giving up
+// after a few tries, so a generation isn't full of flat color.
+func withoutNonFinite(breed func() *picture) *picture {
+	p := breed()
+	for try := 1; try < 10 && tooNonFinite(p); try++ {
+		p = breed()
+	}
+	return p
+}
+
+// channelMap turns the values of a channel into bytes, scaling them and then
+// mapping whatever ends up outside 0..255.
+type channelMap struct {
+	scale, offset float32
+	mapping       string
+}
+
+// newChannelMap maps [-1, 1] onto 0..255 like pictures have always been
+// drawn, unless -normalize asks for the values of node to be stretched to fit
+// instead.
+func newChannelMap(node Node, values []float32, t float32) channelMap {
+	lo, hi := float32(-1), float32(1)
+	switch *normalize {
+	case "":
+		return channelMap{float32(255 / 2), float32(255 / 2), *mapping}
+	case "range":
+		r := RangeAt(node, Interval{Min: -1, Max: 1}, Interval{Min: -1, Max: 1}, Interval{Min: t, Max: t})
+		if !r.Finite() {
+			// nothing better to go on than what the picture shows
+			r = sampledRange(values)
+		}
+		lo, hi = r.Min, r.Max
+	case "sample":
+		r := sampledRange(values)
+		lo, hi = r.Min, r.Max
+	}
+	if !(hi > lo) {
+		// a flat channel, or one without any numbers in it
+		return channelMap{0, 127, *mapping}
+	}
+	scale := 255 / (hi - lo)
+	return channelMap{scale, -lo * scale, *mapping}
+}
+
+// sampledRange is the smallest interval holding the finite values.
+func sampledRange(values []float32) Interval {
+	r := Interval{Min: float32(math.Inf(1)), Max: float32(math.Inf(-1))}
+	for _, v := range values {
+		if math.IsInf(float64(v), 0) || math.IsNaN(float64(v)) {
+			continue
+		}
+		if v < r.Min {
+			r.Min = v
+		}
+		if v > r.Max {
+			r.Max = v
+		}
+	}
+	return r
+}
+
+func (m channelMap) byte(v float32) byte {
+	v = v*m.scale + m.offset
+	switch m.mapping {
+	case "clamp":
+		if !(v > 0) {
+			return 0
+		}
+		if v > 255 {
+			return 255
+		}
+		return byte(v)
+	case "sigmoid":
+		if v != v {
+			return 0
+		}
+		// squeeze everything smoothly into 0..255, the middle stays put
+		return byte(127.5 + 127.5*math.Tanh(float64(v-127.5)/127.5))
+	}
+	// wrap around, which is what pictures have always done. Converting NaN,
+	// Inf or anything too big for an int64 depends on the platform, they
+	// give 0 like they always have on amd64.
+	if !(v > math.MinInt64 && v < math.MaxInt64) {
+		return 0
+	}
+	return byte(int64(v))
+}